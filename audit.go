@@ -0,0 +1,264 @@
+package main
+
+/*-----------------------------------------------
+ audit.go
+
+ Tamper evident, append only record of what went
+ into the stash and what came out of it
+-----------------------------------------------*/
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/* AuditEntry is one line of the audit log.
+   - Seq counts the entries from 1, without gaps
+   - Event is pickup, remove, purge, export or reload
+   - By is who asked for it; the user of a command, the address of
+     an HTTP client, the location a file was dropped in, or the
+     daemon itself for retention and expiry
+   - Prev is the Hash of the entry before, empty for the first
+   - Hash is the SHA-256 of the entry written out with Hash empty
+   Changing an entry breaks its Hash, dropping or reordering entries
+   breaks the Prev of the one after. */
+type AuditEntry struct {
+	Seq      int64
+	Date     time.Time
+	Event    string
+	By       string
+	Node     string `json:",omitempty"`
+	Name     string `json:",omitempty"`
+	Version  int    `json:",omitempty"`
+	Location string `json:",omitempty"`
+	Size     int64  `json:",omitempty"`
+	ChkSum   string `json:",omitempty"`
+	Outcome  string `json:",omitempty"`
+	Verify   string `json:",omitempty"`
+	Delivery string `json:",omitempty"`
+	Detail   string `json:",omitempty"`
+	Prev     string
+	Hash     string
+}
+
+/* AuditHead is the last entry written, kept in its own file. The
+   chain alone can't tell a log cut short from one that ended there,
+   the head can. */
+type AuditHead struct {
+	Seq  int64
+	Hash string
+}
+
+/* Audit is the log Config_loc/audit, JSON lines, with its head in
+   Config_loc/audit.head. The daemon and the commands run without it
+   can both write, so every write takes an flock on the log. */
+type Audit struct {
+	mu sync.Mutex
+}
+
+func auditFile() string {
+	return conf().Config_loc + "/audit"
+}
+
+func auditHeadFile() string {
+	return conf().Config_loc + "/audit.head"
+}
+
+/* The hash of an entry, taken with its Hash empty */
+func (self AuditEntry) digest() (string, error) {
+	self.Hash = ""
+	bts, err := json.Marshal(self)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(bts)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+/* Find the entry to chain the next one to. The head says, if it's
+   gone the last line of the log does. */
+func auditTail(fl *os.File) (head AuditHead, err error) {
+	if bts, err := ioutil.ReadFile(auditHeadFile()); err == nil {
+		return head, json.Unmarshal(bts, &head)
+	}
+	fl.Seek(0, 0)
+	scanner := bufio.NewScanner(fl)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var ent AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &ent) == nil {
+			head = AuditHead{ent.Seq, ent.Hash}
+		}
+	}
+	if head.Seq > 0 {
+		log.Warnln("The audit head is missing, chaining on to entry", head.Seq)
+	}
+	return head, scanner.Err()
+}
+
+func writeAuditHead(head AuditHead) error {
+	bts, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+	tmp := auditHeadFile() + ".new"
+	if err = ioutil.WriteFile(tmp, bts, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, auditHeadFile())
+}
+
+/* Append an entry to the audit log, it's on disk when this returns.
+   A failure is logged and returned, the operation itself already
+   happened. */
+func (self *Audit) Record(ent AuditEntry) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	err := self.record(ent)
+	if err != nil {
+		log.Errorln("Failed to write", ent.Event, "of", ent.Name, "to the audit log:", err)
+	}
+	return err
+}
+
+func (self *Audit) record(ent AuditEntry) error {
+	fl, err := os.OpenFile(auditFile(), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer fl.Close()
+	if err = syscall.Flock(int(fl.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(fl.Fd()), syscall.LOCK_UN)
+
+	head, err := auditTail(fl)
+	if err != nil {
+		return err
+	}
+	ent.Seq = head.Seq + 1
+	ent.Prev = head.Hash
+	ent.Date = time.Now().UTC()
+	if ent.Hash, err = ent.digest(); err != nil {
+		return err
+	}
+	bts, err := json.Marshal(ent)
+	if err != nil {
+		return err
+	}
+	if _, err = fl.Write(append(bts, '\n')); err != nil {
+		return err
+	}
+	if err = fl.Sync(); err != nil {
+		return err
+	}
+	return writeAuditHead(AuditHead{ent.Seq, ent.Hash})
+}
+
+/* Record a change of config */
+func (self *Audit) Reload(by string, err error) {
+	ent := AuditEntry{Event: "reload", By: by, Outcome: "applied"}
+	if err != nil {
+		ent.Outcome = "rejected"
+		ent.Detail = err.Error()
+	}
+	self.Record(ent)
+}
+
+/* Record an export of a file */
+func (self *Audit) Export(by string, node Node, file FilePointer, dest string, err error) {
+	ent := AuditEntry{Event: "export", By: by, Node: node.Id, Name: file.Name, Version: file.Version,
+		Location: file.Location, Size: file.Size, Outcome: "exported", Detail: dest}
+	if err != nil {
+		ent.Outcome = "failed"
+		ent.Detail = dest + ": " + err.Error()
+	}
+	self.Record(ent)
+}
+
+/* Who is running this command, for the audit log */
+func currentUser() string {
+	if usr, err := user.Current(); err == nil {
+		return usr.Username
+	}
+	return "uid " + strconv.Itoa(os.Getuid())
+}
+
+/* Check the audit log from start to end, every hash, every link and
+   the head. Returns how many entries there are and the last hash, or
+   what is wrong at the first problem found. */
+func verifyAudit() (count int64, last string, err error) {
+	fl, err := os.Open(auditFile())
+	if os.IsNotExist(err) {
+		return 0, "", errors.New("There is no audit log: " + auditFile())
+	} else if err != nil {
+		return 0, "", err
+	}
+	defer fl.Close()
+	scanner := bufio.NewScanner(fl)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var ent AuditEntry
+		if err = json.Unmarshal(line, &ent); err != nil {
+			return count, last, fmt.Errorf("Entry %d is unreadable: %v", count+1, err)
+		}
+		if ent.Seq != count+1 {
+			return count, last, fmt.Errorf("Entry %d has sequence %d, entries are missing or out of order", count+1, ent.Seq)
+		}
+		if ent.Prev != last {
+			return count, last, fmt.Errorf("Entry %d doesn't follow on from entry %d", ent.Seq, count)
+		}
+		sum, _ := ent.digest()
+		redone, _ := json.Marshal(ent)
+		if sum != ent.Hash || !bytes.Equal(redone, line) {
+			return count, last, fmt.Errorf("Entry %d has been altered", ent.Seq)
+		}
+		count, last = ent.Seq, ent.Hash
+	}
+	if err = scanner.Err(); err != nil {
+		return count, last, err
+	}
+
+	bts, err := ioutil.ReadFile(auditHeadFile())
+	if err != nil {
+		return count, last, errors.New("The audit head is missing, unable to tell if the log was cut short")
+	}
+	var head AuditHead
+	if err = json.Unmarshal(bts, &head); err != nil {
+		return count, last, errors.New("The audit head is unreadable: " + err.Error())
+	}
+	switch {
+	case head.Seq > count:
+		return count, last, fmt.Errorf("The audit log was cut short, it ends at entry %d but the head is at %d", count, head.Seq)
+	case head.Seq != count || head.Hash != last:
+		return count, last, fmt.Errorf("The audit head (entry %d) doesn't match the end of the log (entry %d)", head.Seq, count)
+	}
+	return count, last, nil
+}
+
+/* The audit command, only verify for now */
+func runAudit(args []string) error {
+	if len(args) != 1 || args[0] != "verify" {
+		return errors.New("Audit requires verify")
+	}
+	count, last, err := verifyAudit()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Audit log intact, %d entries, head %s\n", count, last)
+	return nil
+}
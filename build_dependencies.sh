@@ -57,3 +57,10 @@ fi
 echo "Installing go-uuid"
 go get github.com/google/uuid
 
+if [ -e "$GOPATH/src/github.com/pkg/sftp" ]; then
+    echo "Removing previous installation of sftp"
+    rm -rf "$GOPATH/src/github.com/pkg/sftp"
+fi
+echo "Installing sftp and ssh"
+go get golang.org/x/crypto/ssh
+go get github.com/pkg/sftp
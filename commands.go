@@ -0,0 +1,273 @@
+package main
+
+/*-----------------------------------------------
+ commands.go
+
+ The management commands; list, export, remove
+ and friends, run either against the meta file
+ or through a running daemon
+-----------------------------------------------*/
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/* Stash is what the management commands work against. When a daemon
+   is running it owns the meta data and every command goes through
+   its control socket (remoteStash), otherwise the commands work on
+   the meta file directly (localStash).
+   Remove returns a question instead of removing when it isn't sure
+   what was meant, call it again with confirm set once the user has
+   answered yes. */
+type Stash interface {
+	List() ([]Node, error)
+	Remove(stash_node string, confirm bool) (question string, err error)
+	Export(stash_node string, dest string) error
+	Hold(stash_node string, reason string) error
+	Release(stash_node string) error
+	Retention(dry_run bool) ([]Prune, error)
+	Trash(cmd string, ids []string) ([]TrashEntry, error)
+}
+
+/* localStash works on a Meta directly. In the daemon it is only
+   ever used from the stash go routine. by is who the commands are
+   run for, it goes in the audit log */
+type localStash struct {
+	meta *Meta
+	by   string
+}
+
+func (self localStash) List() ([]Node, error) {
+	return self.meta.Files, nil
+}
+
+func (self localStash) Remove(stash_node string, confirm bool) (question string, err error) {
+	err = self.meta.RemoveFile(stash_node, self.by, func(q string) bool {
+		question = q
+		return confirm
+	})
+	if confirm {
+		question = ""
+	}
+	return
+}
+
+func (self localStash) Export(stash_node string, dest string) error {
+	exports, err := self.meta.prepareExport(stash_node, dest)
+	if err != nil {
+		return err
+	}
+	return runExports(exports, self.by)
+}
+
+func (self localStash) Hold(stash_node string, reason string) error {
+	return self.meta.HoldFile(stash_node, reason)
+}
+
+func (self localStash) Release(stash_node string) error {
+	return self.meta.ReleaseFile(stash_node)
+}
+
+func (self localStash) Retention(dry_run bool) ([]Prune, error) {
+	if dry_run {
+		return self.meta.RetentionPlan(time.Now()), nil
+	}
+	return self.meta.ApplyRetention(self.by), nil
+}
+
+func (self localStash) Trash(cmd string, ids []string) (trash []TrashEntry, err error) {
+	switch cmd {
+	case "list":
+		trash = self.meta.Trash
+	case "restore":
+		for itr := 0; itr < len(ids) && err == nil; itr++ {
+			err = self.meta.RestoreTrash(ids[itr])
+		}
+	case "empty":
+		err = self.meta.EmptyTrash(ids, self.by)
+	default:
+		err = errors.New("Trash requires one of list, restore or empty")
+	}
+	return
+}
+
+/* Pick the stash to run commands against, the daemon if one is
+   listening on the control socket, the meta file otherwise. The
+   meta file stays locked until the command is done with it. */
+func openStash() (Stash, error) {
+	if remote, err := dialControl(); err == nil {
+		log.Debugln("Using the running daemon's stash")
+		return remote, nil
+	}
+	if err := meta.lockMeta(); err != nil {
+		return nil, err
+	}
+	meta.LoadStashFile()
+	return localStash{&meta, currentUser()}, nil
+}
+
+/* Pause or resume intake on the running daemon, for a location or
+   all of them */
+func runPause(command string, args []string) error {
+	if len(args) > 1 {
+		return errors.New("Pause and resume take at most one location")
+	}
+	location := ""
+	if len(args) == 1 && intakeLocation(args[0]) && !filepath.IsAbs(args[0]) {
+		location = args[0] //sftp:<tenant> or the upload location
+	} else if len(args) == 1 {
+		abs, err := filepath.Abs(args[0]) //the daemon doesn't share our working directory
+		if err != nil {
+			return err
+		}
+		location = abs
+	}
+	remote, err := dialControl()
+	if err != nil {
+		return errors.New("No running daemon to " + command)
+	}
+	defer remote.Close()
+	if command == "pause" {
+		return remote.Pause(location)
+	}
+	return remote.Resume(location)
+}
+
+/* Run one of the management commands */
+func runCommand(command string, args []string) (err error) {
+	if command == "pause" || command == "resume" {
+		return runPause(command, args)
+	}
+	if command == "audit" {
+		return runAudit(args)
+	}
+	if command == "receipt" {
+		return runReceipt(args)
+	}
+	stash, err := openStash()
+	if err != nil {
+		return err
+	}
+	if closer, ok := stash.(*remoteStash); ok {
+		defer closer.Close()
+	} else {
+		defer meta.unlockMeta()
+	}
+
+	switch command {
+	case "list":
+		files, err := stash.List()
+		switch {
+		case err != nil:
+		case len(args) > 0 && args[0] == "deliveries":
+			printDeliveries(files)
+		case len(args) > 0 && strings.HasPrefix(args[0], delivery_prefix):
+			var id string
+			if id, err = findDelivery(files, args[0]); err == nil {
+				printList(filterDelivery(files, id))
+			}
+		default:
+			printList(files)
+		}
+		return err
+	case "export":
+		log.Debugln("Length of args is:", len(args))
+		if len(args) != 2 {
+			return errors.New("Copy requires both a source and a destination")
+		}
+		dest, err := filepath.Abs(args[1]) //the daemon doesn't share our working directory
+		if err != nil {
+			return err
+		}
+		log.Debugln("output file:", dest)
+		return stash.Export(args[0], dest)
+	case "remove":
+		log.Debugln("Length of args is:", len(args))
+		for _, stash_node := range args {
+			question, err := stash.Remove(stash_node, false)
+			if err == nil && question != "" {
+				log.Println(question)
+				if Ask("no") {
+					_, err = stash.Remove(stash_node, true)
+				}
+			}
+			if err != nil {
+				log.Errorln(err)
+			}
+		}
+	case "hold":
+		if len(args) < 2 {
+			return errors.New("Hold requires a stash or file and a reason")
+		}
+		return stash.Hold(args[0], strings.Join(args[1:], " "))
+	case "release":
+		if len(args) < 1 {
+			return errors.New("Release requires a stash or file")
+		}
+		for _, stash_node := range args {
+			if err := stash.Release(stash_node); err != nil {
+				log.Errorln(err)
+			}
+		}
+	case "trash":
+		if len(args) < 1 {
+			return errors.New("Trash requires one of list, restore or empty")
+		}
+		if args[0] == "restore" && len(args) < 2 {
+			return errors.New("Restore requires one or more trash ids")
+		}
+		if args[0] == "empty" && len(args) == 1 {
+			log.Println("Permanently delete everything in the trash... are you sure? [yes/No]")
+			if !Ask("no") {
+				return nil
+			}
+		}
+		trash, err := stash.Trash(args[0], args[1:])
+		if err == nil && args[0] == "list" {
+			printTrash(trash)
+		}
+		return err
+	case "retention":
+		dry_run := len(args) > 0 && (args[0] == "--dry-run" || args[0] == "-dry-run")
+		plan, err := stash.Retention(dry_run)
+		if err == nil {
+			printPlan(plan, dry_run)
+		}
+		return err
+	}
+	return
+}
+
+/* Print the stash for the list command */
+func printList(files []Node) {
+	const layout = "Jan 02 06 15:04:23"
+	/*TODO; this would be a perfect fit for text/templates*/
+	for _, node := range files {
+		for _, file := range node.Pointers {
+			nm := file.Name
+			if len(file.Name) > 30 {
+				nm = file.Name[:27] + "..."
+			}
+			np := file.Location
+			if len(file.Location) > 35 {
+				np = file.Location[:32] + "..."
+			}
+			held := ""
+			if file.Held() {
+				held = "HELD: " + file.Hold.Reason
+			} else if node.Hold != nil {
+				held = "HELD: " + node.Hold.Reason
+			}
+			if file.Verify == Mismatch {
+				held = strings.TrimSpace("CORRUPT " + held)
+			}
+			fmt.Printf("%-36s %-30s %10d %3d %-40s %v %s\n",
+				node.Id, nm, file.Size, file.Version, np, file.VersionDate.Format(layout), held)
+		}
+	}
+}
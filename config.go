@@ -10,9 +10,14 @@ package main
 import (
 	//"encoding/json"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/user"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -22,22 +27,86 @@ import (
    to dropstash. At the moment these are:
    - The locations for the daemon to monitor
    - The location for the daemon to log to
-   - The log roll-over period in days
+   - The log roll-over period in days, the size to roll it over at,
+     how many archives to keep and whether to gzip them
    - The location of the stash
    - The location of the configuration directory
    - The working directory root for the daemon (also config_loc)
-   The configuration file is read only so to reload values you
-   must restart the daemon. This also makes it very thread safe.*/
+   - The default rate limit for a drop location and any per
+     location overrides, keyed by location
+   - The free space watermarks for the stash disk in MB and how
+     often to check them
+   - The retention rules and how often the daemon applies them
+   - The trash location and how many days removed files are kept
+     there before they're gone for good
+   - The unix socket the daemon listens on for management commands
+   - How long to wait on another process holding the meta lock
+   - Where the optional HTTP API listens and the token it wants
+   - The location recorded for files uploaded over HTTP, and how
+     long an unfinished upload is kept around
+   - Where the optional SFTP drop server listens, its host key and
+     the keys of the clients allowed in
+   - How many files are hashed in parallel
+   - How long a shutdown waits on the files already picked up
+   - The log level; debug, info, warning or error
+   - The log format, text or json, and where the log goes; any of
+     file, syslog and journald
+   - Whether the daemon reloads by itself when the config changes
+   - Whether clients get signed receipts for their files, the key
+     they're signed with, and where receipts go for a location
+     other than the drop directory itself
+   - How long a dropped file waits for its checksum sidecar, and a
+     sidecar for its file
+   - How long a location stays quiet before the next file it gets
+     starts a new delivery, 0 to only end deliveries with a marker
+   The configuration file is read only. A reload swaps in a whole
+   new Config, see reload for what takes effect without a restart.*/
 type Config struct {
-	Locations          []string
-	Log_loc            string
-	Log_roll           int
-	Stash_loc          string
-	Stash_save_seconds time.Duration
-	Config_loc         string
-	Staging_loc        string
+	Locations                []string
+	Log_loc                  string
+	Log_roll                 int
+	Log_max_mb               int64
+	Log_archives             int
+	Log_compress             bool
+	Stash_loc                string
+	Stash_save_seconds       time.Duration
+	Config_loc               string
+	Staging_loc              string
+	Rate_limit               RateLimit
+	Location_limits          map[string]RateLimit
+	Disk_low_mb              int64
+	Disk_critical_mb         int64
+	Disk_check_seconds       time.Duration
+	Retention                []RetentionRule
+	Retention_check_minutes  time.Duration
+	Trash_loc                string
+	Trash_ttl_days           int
+	Control_socket           string
+	Meta_lock_seconds        time.Duration
+	Http_listen              string
+	Http_token               string
+	Upload_location          string
+	Upload_expire_hours      time.Duration
+	Sftp_listen              string
+	Sftp_host_key            string
+	Sftp_clients             []SftpClient
+	Hash_workers             int
+	Shutdown_timeout_seconds time.Duration
+	Log_level                string
+	Log_format               string
+	Log_sinks                []string
+	Watch_config             bool
+	Receipts                 bool
+	Receipt_key              string
+	Receipt_dirs             map[string]string
+	Sidecar_wait_seconds     time.Duration
+	Delivery_quiet_seconds   time.Duration
 }
 
+/* Drop-ins for every user of the machine, *.json files in here are
+   applied on top of ~/.dropstash/config in name order */
+const config_dropins = "/etc/dropstash/config.d"
+
 /* LoadConfig initializes the ~/.dropstash location and it's
    config file. The file is simple JSON that directly matches
    the Config structure. The following applies:
@@ -45,23 +114,89 @@ type Config struct {
    - if ~/.dropstash/config doesn't exist create it and
      populate it with resonable defaults
    - if ~/.dropstash/config exists, load it into the global
-     config variable. */
+     config variable.
+   - any drop-ins are applied on top
+   A config that can't be loaded is fatal, see ParseConfig for a
+   load that returns the error instead. */
 func (self *Config) LoadConfig() {
+	if err := self.ParseConfig(true); err != nil {
+		log.Error("Error parsing config file.")
+		log.Fatal(err)
+	}
+	setConfig(self)
+}
+
+/* The config everything runs on, read with conf(). A reload swaps in
+   a whole new one while the monitors, servers and workers are reading
+   it, so it's only ever replaced whole and atomically, never written
+   to in place. */
+var live_config atomic.Value
+
+func conf() *Config {
+	if current, ok := live_config.Load().(*Config); ok {
+		return current
+	}
+	return &Config{}
+}
+
+func setConfig(next *Config) {
+	live_config.Store(next)
+}
+
+/* ParseConfig does the work of LoadConfig, returning any error
+   instead of exiting. The daemon reloads with it, so a bad edit
+   is rejected rather than taking the daemon down. Only with create
+   is a missing config file written out with the defaults, a reload
+   that finds it gone, in the middle of an editor's save or a mv,
+   must not replace it. */
+func (self *Config) ParseConfig(create bool) error {
 
 	//get the current user information
 	usr, err := user.Current()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	//resonable defaults
 	self.Log_loc = usr.HomeDir + "/.dropstash/logs"
 	self.Log_roll = 1
+	self.Log_max_mb = 100
+	self.Log_archives = 7
+	self.Log_compress = true
 	self.Stash_save_seconds = 30
 	self.Stash_loc = usr.HomeDir + "/.dropstash/stash"
 	self.Staging_loc = usr.HomeDir + "/.dropstash/stash/staging"
 	confDir := usr.HomeDir + "/.dropstash"
 	self.Config_loc = confDir
 	self.Locations = nil
+	self.Rate_limit = RateLimit{Files_per_second: 0, Bytes_per_second: 0, Mute_seconds: 60}
+	self.Location_limits = map[string]RateLimit{}
+	self.Disk_low_mb = 1024
+	self.Disk_critical_mb = 100
+	self.Disk_check_seconds = 30
+	self.Retention = nil
+	self.Retention_check_minutes = 60
+	self.Trash_loc = usr.HomeDir + "/.dropstash/stash/trash"
+	self.Trash_ttl_days = 30
+	self.Control_socket = confDir + "/control"
+	self.Meta_lock_seconds = 10
+	self.Http_listen = ""
+	self.Http_token = ""
+	self.Upload_location = "http-upload"
+	self.Upload_expire_hours = 24
+	self.Sftp_listen = ""
+	self.Sftp_host_key = confDir + "/sftp_host_key"
+	self.Sftp_clients = nil
+	self.Hash_workers = 2
+	self.Shutdown_timeout_seconds = 30
+	self.Log_level = "info"
+	self.Log_format = "text"
+	self.Log_sinks = []string{"file"}
+	self.Watch_config = true
+	self.Receipts = false
+	self.Receipt_key = confDir + "/receipt.key"
+	self.Receipt_dirs = map[string]string{}
+	self.Sidecar_wait_seconds = 10
+	self.Delivery_quiet_seconds = 120
 
 	//check for ~/.dropstash
 	if _, err := os.Stat(confDir); os.IsNotExist(err) {
@@ -70,10 +205,12 @@ func (self *Config) LoadConfig() {
 	}
 
 	//check for ~/.dropstash/config, write it if not there
-	if _, err := os.Stat(confDir + "/config"); err != nil {
+	if _, err := os.Stat(confDir + "/config"); err != nil && !create {
+		return errors.New(confDir + "/config is missing")
+	} else if err != nil {
 		fl, err := os.Create(confDir + "/config")
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 		defer fl.Close()
 		st, err := json.MarshalIndent(&self, "", "    ")
@@ -82,21 +219,68 @@ func (self *Config) LoadConfig() {
 	} else { //otherwise load the config file into memory
 		fl, err := os.Open(confDir + "/config")
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 		defer fl.Close()
 		err = json.NewDecoder(fl).Decode(&self)
 		if err != nil {
-			log.Error("Error parsing config file.")
-			log.Fatal(err)
+			return fmt.Errorf("%s/config: %v", confDir, err)
 		}
 	}
+	dropins, _ := filepath.Glob(config_dropins + "/*.json")
+	sort.Strings(dropins)
+	for _, dropin := range dropins {
+		bts, err := ioutil.ReadFile(dropin)
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(bts, &self); err != nil {
+			return fmt.Errorf("%s: %v", dropin, err)
+		}
+	}
+	if err := self.validate(); err != nil {
+		return err
+	}
 
 	//ok got config, check for log location, make if not there
 	if _, err := os.Stat(self.Log_loc); err != nil {
 		err := os.MkdirAll(self.Log_loc, 0700)
 		if err != nil {
-			log.Fatal("Couldn't create log directory.")
+			return errors.New("Couldn't create log directory.")
+		}
+	}
+	return nil
+}
+
+/* Catch the mistakes that would otherwise only show up later on */
+func (self *Config) validate() error {
+	for _, location := range self.Locations {
+		if !filepath.IsAbs(location) {
+			return errors.New("Locations must be absolute paths: " + location)
+		}
+	}
+	if _, err := log.ParseLevel(self.Log_level); err != nil {
+		return errors.New("Invalid Log_level: " + self.Log_level)
+	}
+	if self.Stash_save_seconds <= 0 {
+		return errors.New("Stash_save_seconds must be more than 0")
+	}
+	if self.Retention_check_minutes <= 0 {
+		return errors.New("Retention_check_minutes must be more than 0")
+	}
+	if self.Hash_workers < 0 || self.Shutdown_timeout_seconds < 0 || self.Meta_lock_seconds < 0 {
+		return errors.New("Hash_workers, Shutdown_timeout_seconds and Meta_lock_seconds can't be negative")
+	}
+	if self.Log_format != "text" && self.Log_format != "json" {
+		return errors.New("Log_format must be text or json")
+	}
+	for _, sink := range self.Log_sinks {
+		if sink != "file" && sink != "syslog" && sink != "journald" {
+			return errors.New("Log_sinks can only hold file, syslog and journald: " + sink)
 		}
 	}
+	if self.Log_roll < 0 || self.Log_max_mb < 0 || self.Log_archives < 0 {
+		return errors.New("Log_roll, Log_max_mb and Log_archives can't be negative")
+	}
+	return nil
 }
@@ -0,0 +1,286 @@
+package main
+
+/*-----------------------------------------------
+ control.go
+
+ The daemon's control socket, a JSON-RPC service
+ on a unix socket the management commands use
+ while the daemon is running
+-----------------------------------------------*/
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/* Controller is the RPC service behind the control socket. Every
+   call is handed to the stash go routine as a Control operation, so
+   the daemon stays the one and only owner of Meta and all changes
+   are made one after the other. Each connection gets its own, by is
+   the user on the other end. */
+type Controller struct {
+	by string
+}
+
+/* Arguments shared by the Controller calls, not every call uses all of
+   them */
+type ControlArgs struct {
+	Target  string
+	Dest    string
+	Reason  string
+	Confirm bool
+	DryRun  bool
+	Cmd     string
+	Ids     []string
+}
+
+/* Reply shared by the Controller calls */
+type ControlReply struct {
+	Files    []Node
+	Question string
+	Plan     []Prune
+	Trash    []TrashEntry
+}
+
+/* Hand op to the stash go routine and wait for it to finish */
+func (self *Meta) send(op Operation) error {
+	op.done = make(chan error, 1)
+	select {
+	case self.stash <- op:
+	case <-self.stopped:
+		return errors.New("The daemon is shutting down")
+	}
+	return <-op.done
+}
+
+/* Run fn on the stash go routine and wait for it to finish */
+func (self *Meta) do(fn func(stash localStash) error) error {
+	return self.doAs("dropstash", fn)
+}
+
+/* Same as do, for changes made on behalf of by */
+func (self *Meta) doAs(by string, fn func(stash localStash) error) error {
+	return self.send(Operation{Code: Control, call: func(m *Meta) error { return fn(localStash{m, by}) }})
+}
+
+func (self *Controller) List(args ControlArgs, reply *ControlReply) error {
+	return meta.do(func(stash localStash) (err error) {
+		files, err := stash.List()
+		//deep copy, the stash keeps changing while the reply is encoded
+		for _, node := range files {
+			node.Pointers = append([]FilePointer(nil), node.Pointers...)
+			reply.Files = append(reply.Files, node)
+		}
+		return
+	})
+}
+
+func (self *Controller) Remove(args ControlArgs, reply *ControlReply) error {
+	return meta.doAs(self.by, func(stash localStash) (err error) {
+		reply.Question, err = stash.Remove(args.Target, args.Confirm)
+		return
+	})
+}
+
+/* Only finding and opening the files runs on the stash go routine,
+   the copy doesn't hold up the stash */
+func (self *Controller) Export(args ControlArgs, reply *ControlReply) error {
+	var exports []pendingExport
+	err := meta.doAs(self.by, func(stash localStash) (err error) {
+		exports, err = stash.meta.prepareExport(args.Target, args.Dest)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	return runExports(exports, self.by)
+}
+
+func (self *Controller) Hold(args ControlArgs, reply *ControlReply) error {
+	return meta.doAs(self.by, func(stash localStash) error {
+		return stash.Hold(args.Target, args.Reason)
+	})
+}
+
+func (self *Controller) Release(args ControlArgs, reply *ControlReply) error {
+	return meta.doAs(self.by, func(stash localStash) error {
+		return stash.Release(args.Target)
+	})
+}
+
+func (self *Controller) Retention(args ControlArgs, reply *ControlReply) error {
+	return meta.doAs(self.by, func(stash localStash) (err error) {
+		reply.Plan, err = stash.Retention(args.DryRun)
+		return
+	})
+}
+
+func (self *Controller) Trash(args ControlArgs, reply *ControlReply) error {
+	return meta.doAs(self.by, func(stash localStash) (err error) {
+		trash, err := stash.Trash(args.Cmd, args.Ids)
+		reply.Trash = append([]TrashEntry(nil), trash...)
+		return
+	})
+}
+
+func (self *Controller) Pause(args ControlArgs, reply *ControlReply) error {
+	if args.Target != "" && !intakeLocation(args.Target) {
+		return errors.New("Not a location files come in from: " + args.Target)
+	}
+	return meta.send(Operation{Code: Pause, Location: args.Target})
+}
+
+func (self *Controller) Resume(args ControlArgs, reply *ControlReply) error {
+	if args.Target != "" && !intakeLocation(args.Target) {
+		return errors.New("Not a location files come in from: " + args.Target)
+	}
+	return meta.send(Operation{Code: Resume, Location: args.Target})
+}
+
+func (self *Controller) Status(args ControlArgs, reply *Status) (err error) {
+	*reply, err = daemonStatus()
+	return
+}
+
+/* Only let in connections from our own user, the socket permissions
+   should already see to that but it doesn't hurt to check. Returns
+   who connected, for the audit log. */
+func peerAllowed(conn net.Conn) (string, bool) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return "", false
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return "", false
+	}
+	var cred *syscall.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || (cred.Uid != uint32(os.Getuid()) && cred.Uid != 0) {
+		return "", false
+	}
+	by := "uid " + strconv.Itoa(int(cred.Uid))
+	if usr, err := user.LookupId(strconv.Itoa(int(cred.Uid))); err == nil {
+		by = usr.Username
+	}
+	return by, true
+}
+
+/* Listen on the control socket and serve requests, runs as its own
+   go routine in the daemon */
+func serveControl() {
+	sock := conf().Control_socket
+	os.Remove(sock) //left behind by a daemon that didn't get to clean up
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		log.Errorln("Unable to open the control socket:", err)
+		return
+	}
+	if err = os.Chmod(sock, 0600); err != nil {
+		log.Errorln("Unable to restrict the control socket:", err)
+		ln.Close()
+		return
+	}
+	log.Infoln("Control socket up:", sock)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Errorln("Control socket error:", err)
+			return
+		}
+		by, ok := peerAllowed(conn)
+		if !ok {
+			log.Warnln("Refused control connection from another user")
+			conn.Close()
+			continue
+		}
+		server := rpc.NewServer()
+		server.Register(&Controller{by})
+		go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
+}
+
+/* remoteStash runs the management commands through a running daemon */
+type remoteStash struct {
+	client *rpc.Client
+	conn   net.Conn
+}
+
+/* Connect to the daemon's control socket */
+func dialControl() (*remoteStash, error) {
+	conn, err := net.Dial("unix", conf().Control_socket)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteStash{jsonrpc.NewClient(conn), conn}, nil
+}
+
+func (self *remoteStash) Close() error {
+	return self.client.Close()
+}
+
+func (self *remoteStash) call(method string, args ControlArgs) (reply ControlReply, err error) {
+	err = self.client.Call("Controller."+method, args, &reply)
+	if err != nil {
+		if _, ok := err.(rpc.ServerError); !ok {
+			err = errors.New("Lost the connection to the daemon: " + err.Error())
+		}
+	}
+	return
+}
+
+func (self *remoteStash) List() ([]Node, error) {
+	reply, err := self.call("List", ControlArgs{})
+	return reply.Files, err
+}
+
+func (self *remoteStash) Remove(stash_node string, confirm bool) (string, error) {
+	reply, err := self.call("Remove", ControlArgs{Target: stash_node, Confirm: confirm})
+	return reply.Question, err
+}
+
+func (self *remoteStash) Export(stash_node string, dest string) error {
+	_, err := self.call("Export", ControlArgs{Target: stash_node, Dest: dest})
+	return err
+}
+
+func (self *remoteStash) Hold(stash_node string, reason string) error {
+	_, err := self.call("Hold", ControlArgs{Target: stash_node, Reason: reason})
+	return err
+}
+
+func (self *remoteStash) Release(stash_node string) error {
+	_, err := self.call("Release", ControlArgs{Target: stash_node})
+	return err
+}
+
+func (self *remoteStash) Retention(dry_run bool) ([]Prune, error) {
+	reply, err := self.call("Retention", ControlArgs{DryRun: dry_run})
+	return reply.Plan, err
+}
+
+/* Pause and resume only make sense with a daemon, they aren't part
+   of Stash */
+func (self *remoteStash) Pause(location string) error {
+	_, err := self.call("Pause", ControlArgs{Target: location})
+	return err
+}
+
+func (self *remoteStash) Resume(location string) error {
+	_, err := self.call("Resume", ControlArgs{Target: location})
+	return err
+}
+
+func (self *remoteStash) Trash(cmd string, ids []string) ([]TrashEntry, error) {
+	reply, err := self.call("Trash", ControlArgs{Cmd: cmd, Ids: ids})
+	return reply.Trash, err
+}
@@ -0,0 +1,290 @@
+package main
+
+/*-----------------------------------------------
+ delivery.go
+
+ Files dropped together are a delivery, a batch
+ that can be listed, exported and removed as one
+-----------------------------------------------*/
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/google/uuid"
+)
+
+/* Deliveries tracks the open delivery of each location. A file
+   picked up joins the open delivery of its location, unless nothing
+   was picked up there for Delivery_quiet_seconds, or a marker file
+   ended it, then it opens a new one. Ids are handed out on pickup,
+   in the order files were dropped, so a marker can't be overtaken
+   by the files before it. */
+type Deliveries struct {
+	mu   sync.Mutex
+	open map[string]*openDelivery
+}
+
+type openDelivery struct {
+	id    string
+	last  time.Time
+	files int
+}
+
+/* Delivery targets look like delivery:<id>, a unique prefix of the
+   id will do */
+const delivery_prefix = "delivery:"
+
+/* How often a marker checks whether the files before it are in, and
+   how long it waits for them at most */
+const (
+	delivery_poll         = 5 * time.Second
+	delivery_marker_limit = 10 * time.Minute
+)
+
+/* Is name a marker ending a delivery, .done or anything.done. A
+   marker is a file like any other, it's stashed as the last file of
+   the delivery it ends, whatever is in it. */
+func isDeliveryMarker(name string) bool {
+	return strings.HasSuffix(path.Base(name), ".done")
+}
+
+/* The delivery a file picked up from location belongs to */
+func (self *Deliveries) For(location string) string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.open == nil {
+		self.open = make(map[string]*openDelivery)
+	}
+	now := time.Now()
+	cur := self.open[location]
+	if cur == nil || (conf().Delivery_quiet_seconds > 0 && now.Sub(cur.last) >= conf().Delivery_quiet_seconds*time.Second) {
+		if cur != nil {
+			log.Infoln("Delivery", cur.id, "from", location, "ended after a quiet period,", cur.files, "file(s)")
+		}
+		cur = &openDelivery{id: uuid.New().String()}
+		self.open[location] = cur
+		log.Infoln("Delivery", cur.id, "from", location, "opened")
+	}
+	cur.last = now
+	cur.files++
+	return cur.id
+}
+
+/* End the open delivery of location, returns its id and how many
+   files it had */
+func (self *Deliveries) Close(location string) (id string, files int) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if cur := self.open[location]; cur != nil {
+		delete(self.open, location)
+		return cur.id, cur.files
+	}
+	return "", 0
+}
+
+/* A marker waits until every other file dropped in its location has
+   been picked up, but no longer than delivery_marker_limit after it
+   was dropped; a file that can't be moved or is never finished must
+   not hold the delivery open for good. Returns how long to wait
+   before trying again, 0 once it can go. */
+func markerWait(name string, st os.FileInfo) time.Duration {
+	dir := path.Dir(name)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	var waiting []string
+	for _, ent := range entries {
+		other := dir + "/" + ent.Name()
+		if ent.Mode().IsRegular() && !isReceipt(other) && !isDeliveryMarker(other) {
+			waiting = append(waiting, ent.Name())
+		}
+	}
+	switch {
+	case len(waiting) == 0:
+		return 0
+	case time.Since(st.ModTime()) < delivery_marker_limit:
+		log.Debugln("Delivery marker", path.Base(name), "waiting on", waiting)
+		return delivery_poll
+	}
+	log.Warnln("Delivery marker", path.Base(name), "gave up waiting after", delivery_marker_limit,
+		"ending the delivery without", waiting)
+	return 0
+}
+
+/* End the open delivery of location, a marker picked up there was
+   its last file */
+func closeDelivery(location string) {
+	if id, files := deliveries.Close(location); id != "" {
+		log.Infoln("Delivery", id, "from", location, "complete,", files, "file(s)")
+	}
+}
+
+/* The deliveries in files whose ids start with prefix */
+func deliveryIds(files []Node, prefix string) (ids []string) {
+	seen := map[string]bool{}
+	for _, node := range files {
+		for _, fp := range node.Pointers {
+			if fp.Delivery != "" && strings.HasPrefix(fp.Delivery, prefix) && !seen[fp.Delivery] {
+				seen[fp.Delivery] = true
+				ids = append(ids, fp.Delivery)
+			}
+		}
+	}
+	return
+}
+
+/* Find the one delivery target names, delivery:<id prefix> */
+func findDelivery(files []Node, target string) (string, error) {
+	id := strings.TrimPrefix(target, delivery_prefix)
+	ids := deliveryIds(files, id)
+	switch {
+	case id == "" || len(ids) == 0:
+		return "", errors.New("Unable to find delivery " + id + " in the stash")
+	case len(ids) > 1:
+		return "", errors.New("Delivery id " + id + " is ambiguous")
+	}
+	return ids[0], nil
+}
+
+/* Cut files down to the pointers of a delivery */
+func filterDelivery(files []Node, id string) (delivery []Node) {
+	for _, node := range files {
+		var pointers []FilePointer
+		for _, fp := range node.Pointers {
+			if fp.Delivery == id {
+				pointers = append(pointers, fp)
+			}
+		}
+		if len(pointers) > 0 {
+			node.Pointers = pointers
+			delivery = append(delivery, node)
+		}
+	}
+	return
+}
+
+/* Remove every file of a delivery, after asking confirm. Files on
+   hold keep the whole delivery in place. */
+func (self *Meta) RemoveDelivery(target string, by string, confirm func(question string) bool) error {
+	id, err := findDelivery(self.Files, target)
+	if err != nil {
+		return err
+	}
+	delivery := filterDelivery(self.Files, id)
+	count := 0
+	for _, node := range delivery {
+		if node.Hold != nil {
+			return fmt.Errorf("Stash %s of delivery %s is on hold, refusing to remove it: %s", node.Id, id, node.Hold.Reason)
+		}
+		for _, fp := range node.Pointers {
+			if fp.Held() {
+				return fmt.Errorf("File %s of delivery %s is on hold, refusing to remove it: %s", fp.Name, id, fp.Hold.Reason)
+			}
+			count++
+		}
+	}
+	if !confirm(fmt.Sprintf("Remove all %d file(s) of delivery %s? [yes/No]", count, id)) {
+		return nil
+	}
+	log.Infoln("Removing delivery", id, "from the stash,", count, "file(s)")
+	for itr := range delivery {
+		for _, fp := range delivery[itr].Pointers {
+			file := fp
+			self.pullFromFiles(&delivery[itr], &file, by)
+		}
+	}
+	self.RebuildLookup()
+	return nil
+}
+
+/* The exports of every file of a delivery into the directory dest,
+   oldest first. A name that comes up more than once gets its version
+   tacked on. */
+func (self *Meta) deliveryExports(target string, dest string) (exports []pendingExport, err error) {
+	id, err := findDelivery(self.Files, target)
+	if err != nil {
+		return nil, err
+	}
+	if st, err := os.Stat(dest); err != nil || !st.IsDir() {
+		return nil, errors.New("A delivery can only be exported into a directory: " + dest)
+	}
+	for _, node := range filterDelivery(self.Files, id) {
+		for _, fp := range node.Pointers {
+			exports = append(exports, pendingExport{node: node, file: fp})
+		}
+	}
+	sort.Slice(exports, func(i, j int) bool { return exports[i].file.VersionDate.Before(exports[j].file.VersionDate) })
+
+	taken := map[string]bool{}
+	for itr := range exports {
+		name := exports[itr].file.Name
+		if taken[name] {
+			name = fmt.Sprintf("%s.v%d", name, exports[itr].file.Version)
+		}
+		taken[name] = true
+		exports[itr].dest = dest + "/" + name
+	}
+	log.Infoln("Exporting delivery", id, ",", len(exports), "file(s), to", dest)
+	return
+}
+
+/* Print a line per delivery for list deliveries, oldest first */
+func printDeliveries(files []Node) {
+	const layout = "Jan 02 06 15:04:23"
+	type summary struct {
+		id          string
+		location    string
+		first, last time.Time
+		files       int
+		size        int64
+		corrupt     int
+	}
+	found := map[string]*summary{}
+	var order []*summary
+	for _, node := range files {
+		for _, fp := range node.Pointers {
+			if fp.Delivery == "" {
+				continue
+			}
+			sum := found[fp.Delivery]
+			if sum == nil {
+				sum = &summary{id: fp.Delivery, location: fp.Location, first: fp.VersionDate, last: fp.VersionDate}
+				found[fp.Delivery] = sum
+				order = append(order, sum)
+			}
+			if fp.VersionDate.Before(sum.first) {
+				sum.first = fp.VersionDate
+			}
+			if fp.VersionDate.After(sum.last) {
+				sum.last = fp.VersionDate
+			}
+			sum.files++
+			sum.size += fp.Size
+			if fp.Verify == Mismatch {
+				sum.corrupt++
+			}
+		}
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i].first.Before(order[j].first) })
+	for _, sum := range order {
+		np := sum.location
+		if len(sum.location) > 35 {
+			np = sum.location[:32] + "..."
+		}
+		corrupt := ""
+		if sum.corrupt > 0 {
+			corrupt = fmt.Sprintf("CORRUPT: %d", sum.corrupt)
+		}
+		fmt.Printf("%-36s %-35s %4d %12d %v - %v %s\n", sum.id, np, sum.files, sum.size,
+			sum.first.Format(layout), sum.last.Format(layout), corrupt)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+/*-----------------------------------------------
+ disk.go
+
+ Keeps an eye on the free space left where the
+ stash lives
+-----------------------------------------------*/
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/* DiskWatch tracks the free space on the Stash_loc filesystem
+   against the two watermarks in the config:
+   - below Disk_low_mb we warn
+   - below Disk_critical_mb we stop moving files into staging,
+     they stay in the drop locations until space is freed up
+   When the space comes back every monitor is asked to sweep its
+   location so nothing left behind gets forgotten. */
+type DiskWatch struct {
+	mu       sync.Mutex
+	low      bool
+	critical bool
+}
+
+/* Free bytes available to us on the filesystem holding loc */
+func freeSpace(loc string) (free uint64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(loc, &st); err != nil {
+		return
+	}
+	free = st.Bavail * uint64(st.Bsize)
+	return
+}
+
+/* Check the free space and report whether intake may continue.
+   Transitions between the watermarks are logged once. */
+func (self *DiskWatch) Check() (ok bool) {
+	free, err := freeSpace(conf().Stash_loc)
+	if err != nil {
+		log.Errorln("Unable to check free space on", conf().Stash_loc, ":", err)
+		return true //don't stop intake because we couldn't look
+	}
+	mb := int64(free / (1024 * 1024))
+	low := conf().Disk_low_mb > 0 && mb < conf().Disk_low_mb
+	critical := conf().Disk_critical_mb > 0 && mb < conf().Disk_critical_mb
+
+	self.mu.Lock()
+	was_critical := self.critical
+	if low && !self.low {
+		log.Warnf("Free space on %s is low: %d MB left (low mark %d MB)", conf().Stash_loc, mb, conf().Disk_low_mb)
+	}
+	if critical && !self.critical {
+		log.Errorf("Free space on %s is critical: %d MB left (critical mark %d MB), pausing intake", conf().Stash_loc, mb, conf().Disk_critical_mb)
+	}
+	if !low && self.low {
+		log.Infof("Free space on %s is back to %d MB", conf().Stash_loc, mb)
+	}
+	self.low = low
+	self.critical = critical
+	self.mu.Unlock()
+
+	if was_critical && !critical {
+		log.Infoln("Free space recovered, resuming intake")
+		requestSweep()
+	}
+	return !critical
+}
+
+/* Critical reports the last known state without touching the disk */
+func (self *DiskWatch) Critical() bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.critical
+}
+
+/* State describes the last known state: ok, low or critical */
+func (self *DiskWatch) State() string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	switch {
+	case self.critical:
+		return "critical"
+	case self.low:
+		return "low"
+	}
+	return "ok"
+}
+
+/* Periodic check, runs as its own go routine in the daemon */
+func (self *DiskWatch) watch() {
+	if conf().Disk_check_seconds <= 0 {
+		return
+	}
+	for {
+		self.Check()
+		time.Sleep(conf().Disk_check_seconds * time.Second)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+/*-----------------------------------------------
+ hashpool.go
+
+ Hashes staged files in parallel, ahead of the
+ stash
+-----------------------------------------------*/
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/* HashPool sits between intake and the stash. Hash_workers workers
+   open and hash staged files in parallel, and hand the results to
+   the stash go routine, the one and only writer of Meta, which is
+   left with de-duplicating and committing them one at a time. A big
+   file only ever holds up the worker hashing it.
+   - busy counts the workers hashing
+   - waiting counts the hashed files waiting on the stash */
+type HashPool struct {
+	mu      sync.Mutex
+	work    chan Operation
+	workers int
+	busy    int
+	waiting int
+}
+
+/* HashStatus is what status reports on the pool. The pool is
+   saturated when every worker is busy and files are queued behind
+   them. */
+type HashStatus struct {
+	Workers   int
+	Busy      int
+	Waiting   int
+	Saturated bool
+}
+
+func (self *HashPool) init() {
+	self.work = make(chan Operation)
+	self.workers = conf().Hash_workers
+	if self.workers < 1 {
+		self.workers = 1
+	}
+}
+
+/* Start the workers, each runs as its own go routine */
+func (self *HashPool) start() {
+	log.Infoln("Starting", self.workers, "hash workers")
+	for itr := 0; itr < self.workers; itr++ {
+		go self.worker()
+	}
+}
+
+func (self *HashPool) count(counter *int, delta int) {
+	self.mu.Lock()
+	*counter += delta
+	self.mu.Unlock()
+}
+
+func (self *HashPool) Status() HashStatus {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return HashStatus{self.workers, self.busy, self.waiting, self.busy >= self.workers && intake.Pending() > 0}
+}
+
+func (self *HashPool) worker() {
+	for op := range self.work {
+		self.count(&self.busy, 1)
+		node, fl, digest, err := prepare(op)
+		self.count(&self.busy, -1)
+		if err != nil {
+			log.Errorln(err)
+			continue
+		}
+		op.node = &node
+		op.file = fl
+		op.digest = digest
+		self.count(&self.waiting, 1)
+		select {
+		case meta.stash <- op:
+		case <-meta.stopped: //still journaled, the next start picks it up
+			fl.Close()
+		}
+		self.count(&self.waiting, -1)
+	}
+}
+
+/* Open and hash a staged file, ready for the stash to append. A file
+   that was hashed on its way into staging isn't read again. The
+   version is dated when the file was picked up, not when a worker
+   got round to it, so files keep the order they were dropped in. */
+func prepare(op Operation) (file Node, fl *os.File, digest *Digest, err error) {
+	fl, err = os.Open(conf().Staging_loc + "/" + op.Id)
+	if err != nil {
+		journal.Done(op.Id) //it's gone, nothing to replay
+		return file, nil, nil, errors.New("Failed to open staging file: " + op.Id)
+	}
+	file.Id = op.Id
+	file.Overwrite = op.Overwrite
+	if fd, err := fl.Stat(); err != nil {
+		fl.Close()
+		return file, nil, nil, errors.New("Failed to get stats on staged file: " + file.Id)
+	} else {
+		file.Size = fd.Size()
+	}
+	digest = op.digest
+	if digest == nil || digest.Size != file.Size || (op.declared.wantsSha256() && digest.Sha256 == "") {
+		digest = new(Digest)
+		if *digest, err = hashStream(nil, fl, op.declared.wantsSha256()); err != nil || digest.Size != file.Size {
+			fl.Close()
+			return file, nil, nil, errors.New("Failed to hash staged file: " + file.Id)
+		}
+	}
+	file.ChkSum = digest.ChkSum
+	file.PickupCount = 1
+	file.PartialCount = 0
+	picked := op.picked
+	if picked.IsZero() { //journaled by a daemon that didn't keep it
+		picked = time.Now()
+	}
+	pointer := FilePointer{Name: op.Name, Location: op.Location, Size: file.Size, VersionDate: picked,
+		Verify: op.declared.check(digest), Delivery: op.delivery}
+	if pointer.Verify == Mismatch {
+		log.WithFields(log.Fields{"event": "verify", "id": op.Id, "name": op.Name, "location": op.Location,
+			"size": file.Size, "outcome": Mismatch}).Warnln(op.Name, "from", op.Location, "doesn't match the",
+			op.declared.Algo, "in", op.declared.Source, "- stashing it flagged as corrupt")
+	}
+	file.Pointers = append(file.Pointers, pointer)
+	return
+}
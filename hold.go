@@ -0,0 +1,116 @@
+package main
+
+/*-----------------------------------------------
+ hold.go
+
+ Legal holds, freezing a stash or a single file
+ version against removal and expiry
+-----------------------------------------------*/
+import (
+	"errors"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/* Hold marks a Node or a FilePointer as frozen. Held items can't
+   be removed, expired by retention or freed, until released.
+   - Reason is whatever the person placing the hold gave us
+   - Date is when the hold was placed */
+type Hold struct {
+	Reason string
+	Date   time.Time
+}
+
+/* Held reports whether the pointer itself is on hold */
+func (self *FilePointer) Held() bool {
+	return self.Hold != nil
+}
+
+/* Held reports whether the node is on hold, either as a whole or
+   through any one of its pointers. Either way the node itself must
+   stay in the stash. */
+func (self *Node) Held() bool {
+	if self.Hold != nil {
+		return true
+	}
+	for itr := range self.Pointers {
+		if self.Pointers[itr].Held() {
+			return true
+		}
+	}
+	return false
+}
+
+/* Find the live node and pointer in Files for a lookup string. The
+   lookup table only holds copies, so anything that needs to change
+   a node must come through here. The version must be exact. */
+func (self *Meta) resolve(stash_node string) (node *Node, file *FilePointer, err error) {
+	found, fp, exact := self.Lookup(stash_node)
+	if found == nil {
+		return nil, nil, errors.New("Unable to find " + stash_node + " in the stash")
+	}
+	if fp != nil && !exact {
+		return nil, nil, errors.New("More than one version of " + stash_node + ", please give the version")
+	}
+	for itr := range self.Files {
+		if !self.Files[itr].Compare(found) {
+			continue
+		}
+		node = &self.Files[itr]
+		if fp == nil {
+			return
+		}
+		for fitr := range node.Pointers {
+			if node.Pointers[fitr].Compare(fp) {
+				file = &node.Pointers[fitr]
+				return
+			}
+		}
+	}
+	return nil, nil, errors.New("Unable to find " + stash_node + " in the stash")
+}
+
+/* Place a hold on a stash or a single file version:
+   {stashid}/<filename><:version> */
+func (self *Meta) HoldFile(stash_node string, reason string) error {
+	node, file, err := self.resolve(stash_node)
+	if err != nil {
+		return err
+	}
+	hold := &Hold{reason, time.Now()}
+	if file != nil {
+		log.Infoln("Placing hold on file:", file.Name, "version:", file.Version, "in stash:", node.Id, "-", reason)
+		file.Hold = hold
+	} else {
+		log.Infoln("Placing hold on stash:", node.Id, "-", reason)
+		node.Hold = hold
+	}
+	self.RebuildLookup()
+	self.SaveStash()
+	return nil
+}
+
+/* Release a hold placed with HoldFile */
+func (self *Meta) ReleaseFile(stash_node string) error {
+	node, file, err := self.resolve(stash_node)
+	if err != nil {
+		return err
+	}
+	if file != nil {
+		if !file.Held() {
+			return errors.New(stash_node + " is not on hold")
+		}
+		log.Infoln("Releasing hold on file:", file.Name, "version:", file.Version, "in stash:", node.Id)
+		file.Hold = nil
+	} else {
+		if node.Hold == nil {
+			return errors.New(stash_node + " is not on hold")
+		}
+		log.Infoln("Releasing hold on stash:", node.Id)
+		node.Hold = nil
+	}
+	self.RebuildLookup()
+	self.SaveStash()
+	return nil
+}
@@ -0,0 +1,302 @@
+package main
+
+/*-----------------------------------------------
+ http.go
+
+ Optional local HTTP API for listing, fetching
+ and removing what's in the stash
+-----------------------------------------------*/
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/* Stats is the summary served by /api/stats
+   - Physical is the bytes actually kept in the stash
+   - Logical is the bytes of every version ever picked up, the
+     difference is what de-duplication saved us */
+type Stats struct {
+	Nodes    int
+	Pointers int
+	Held     int
+	Physical int64
+	Logical  int64
+	Trash    int
+	Pending  int
+}
+
+/* Compute the stash stats, stash go routine only */
+func (self *Meta) Stats() (stats Stats) {
+	stats.Nodes = len(self.Files)
+	stats.Trash = len(self.Trash)
+	for _, node := range self.Files {
+		stats.Physical += node.Size
+		if node.Hold != nil {
+			stats.Held++
+		}
+		for _, fp := range node.Pointers {
+			stats.Pointers++
+			stats.Logical += fp.Size
+			if fp.Held() {
+				stats.Held++
+			}
+		}
+	}
+	return
+}
+
+/* Write v out as JSON */
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	enc.Encode(v)
+}
+
+/* Write an error out as JSON */
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJson(w, status, map[string]string{"Error": err.Error()})
+}
+
+/* Who is on the other end of a request, for the audit log. The
+   token is shared, so the address is all there is to go on. */
+func httpClient(r *http.Request) string {
+	return "http " + r.RemoteAddr
+}
+
+/* Wrap a handler so it only runs with the right bearer token */
+func authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(conf().Http_token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("Invalid or missing token"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+/* Does a pointer pass the filters given in the query string:
+   name, location, since (RFC3339), held (true/false), verify
+   (verified, mismatch or unverified) and delivery (id) */
+func matches(node *Node, fp *FilePointer, query map[string][]string) bool {
+	get := func(key string) string {
+		if v := query[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	if name := get("name"); name != "" && !strings.Contains(fp.Name, name) {
+		return false
+	}
+	if loc := get("location"); loc != "" && fp.Location != loc {
+		return false
+	}
+	if since := get("since"); since != "" {
+		if t, err := time.Parse(time.RFC3339, since); err == nil && fp.VersionDate.Before(t) {
+			return false
+		}
+	}
+	if delivery := get("delivery"); delivery != "" && fp.Delivery != delivery {
+		return false
+	}
+	if verify := get("verify"); verify != "" && fp.Verify != verify {
+		return false
+	}
+	if held := get("held"); held != "" && (held == "true") != (fp.Held() || node.Hold != nil) {
+		return false
+	}
+	return true
+}
+
+/* GET /api/nodes[/{id}] lists the stash, DELETE /api/nodes/{id}
+   removes a whole stash */
+func handleNodes(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/nodes"), "/")
+	switch {
+	case r.Method == "GET":
+		var nodes []Node
+		err := meta.do(func(stash localStash) error {
+			files, _ := stash.List()
+			for _, node := range files {
+				if id != "" && node.Id != id {
+					continue
+				}
+				var pointers []FilePointer
+				for itr := range node.Pointers {
+					if matches(&node, &node.Pointers[itr], r.URL.Query()) {
+						pointers = append(pointers, node.Pointers[itr])
+					}
+				}
+				if len(pointers) > 0 || (id != "" && len(r.URL.Query()) == 0) {
+					node.Pointers = pointers
+					nodes = append(nodes, node)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+		} else if id != "" && len(nodes) == 0 {
+			writeError(w, http.StatusNotFound, errors.New("Unable to find "+id+" in the stash"))
+		} else if id != "" {
+			writeJson(w, http.StatusOK, nodes[0])
+		} else {
+			writeJson(w, http.StatusOK, nodes)
+		}
+	case r.Method == "DELETE" && id != "":
+		removeTarget(w, r, id, true)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+	}
+}
+
+/* GET /api/files/{id}/{name}?version=N streams the bytes of a file,
+   DELETE removes that version */
+func handleFiles(w http.ResponseWriter, r *http.Request) {
+	target := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/files"), "/")
+	if !strings.Contains(target, "/") {
+		writeError(w, http.StatusBadRequest, errors.New("Expected /api/files/{id}/{name}"))
+		return
+	}
+	version := r.URL.Query().Get("version")
+	if version != "" {
+		if _, err := strconv.Atoi(version); err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("Invalid version: "+version))
+			return
+		}
+		target += ":" + version
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		var fl *os.File
+		var stashed Node
+		var file FilePointer
+		err := meta.do(func(stash localStash) (err error) {
+			node, fp, exact := stash.meta.Lookup(target)
+			if node == nil || fp == nil || (version != "" && !exact) { //no falling back on another version
+				return errors.New("Unable to find " + target + " in the stash")
+			}
+			stashed, file = *node, *fp
+			//opened while we own the stash, the bytes stay put for us
+			//even if the stash is extended or removed later
+			fl, err = os.Open(conf().Stash_loc + "/" + node.Id)
+			return
+		})
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		defer fl.Close()
+		log.Infoln("HTTP export of", target, "to", r.RemoteAddr)
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+strings.Replace(file.Name, "\"", "", -1)+"\"")
+		http.ServeContent(w, r, file.Name, file.VersionDate, io.NewSectionReader(fl, 0, file.Size))
+		if r.Method == "GET" {
+			audit.Export(httpClient(r), stashed, file, "http", nil)
+		}
+	case "DELETE":
+		removeTarget(w, r, target, false)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+	}
+}
+
+/* Remove through the stash, anything ambiguous is a conflict */
+func removeTarget(w http.ResponseWriter, r *http.Request, target string, confirm bool) {
+	var question string
+	err := meta.doAs(httpClient(r), func(stash localStash) (err error) {
+		question, err = stash.Remove(target, confirm)
+		return
+	})
+	switch {
+	case err != nil:
+		writeError(w, http.StatusConflict, err)
+	case question != "":
+		writeError(w, http.StatusConflict, errors.New("Ambiguous, give the version to remove"))
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+/* GET /api/stats */
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	var stats Stats
+	err := meta.do(func(stash localStash) error {
+		stats = stash.meta.Stats()
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	stats.Pending = intake.Pending()
+	writeJson(w, http.StatusOK, stats)
+}
+
+/* Start the HTTP API if one is configured, runs as its own go
+   routine in the daemon. Http_listen is either host:port, which
+   must be a loopback address, or unix:/path/to/socket */
+func serveHttp() {
+	if conf().Http_listen == "" {
+		return
+	}
+	if conf().Http_token == "" {
+		log.Errorln("Http_token must be set to run the HTTP API, not starting it")
+		return
+	}
+
+	var ln net.Listener
+	var err error
+	if strings.HasPrefix(conf().Http_listen, "unix:") {
+		sock := strings.TrimPrefix(conf().Http_listen, "unix:")
+		os.Remove(sock)
+		if ln, err = net.Listen("unix", sock); err == nil {
+			err = os.Chmod(sock, 0660)
+		}
+	} else {
+		if host, _, err := net.SplitHostPort(conf().Http_listen); err == nil {
+			if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+				log.Errorln("Http_listen", conf().Http_listen, "isn't a loopback address, not starting the HTTP API")
+				return
+			}
+		}
+		ln, err = net.Listen("tcp", conf().Http_listen)
+	}
+	if err != nil {
+		log.Errorln("Unable to start the HTTP API:", err)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/nodes", authorized(handleNodes))
+	mux.HandleFunc("/api/nodes/", authorized(handleNodes))
+	mux.HandleFunc("/api/files/", authorized(handleFiles))
+	mux.HandleFunc("/api/stats", authorized(handleStats))
+	mux.HandleFunc("/api/uploads", authorized(handleUploads))
+	mux.HandleFunc("/api/uploads/", authorized(handleUploads))
+	mux.HandleFunc("/metrics", authorized(handleMetrics))
+	server := &http.Server{Handler: mux}
+	onShutdown(func(deadline time.Time) {
+		//let running requests, uploads in particular, finish in time
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+	log.Infoln("HTTP API up:", conf().Http_listen)
+	if err = server.Serve(ln); err != nil && err != http.ErrServerClosed {
+		log.Errorln("HTTP API stopped:", err)
+	}
+}
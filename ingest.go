@@ -0,0 +1,158 @@
+package main
+
+/*-----------------------------------------------
+ ingest.go
+
+ Streaming hash of incoming files, with prefix
+ hashes at the sizes of the files in the stash
+-----------------------------------------------*/
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/* Digest is everything de-duplication needs to know about the bytes
+   of an incoming file, worked out in a single pass over them.
+   - ChkSum is the md5 of the whole file, Size bytes of it
+   - Prefixes are the md5 of the first n bytes, for every n that is
+     the size of a file in the stash and smaller than this one
+   - Sha256 is only taken when a sidecar asks for it
+   It is kept on the staged file's journal entry. append only reads
+   the incoming bytes again for a stash file whose size has no prefix
+   here, once the stash holds more than max_checkpoints sizes. */
+type Digest struct {
+	Size     int64
+	ChkSum   string
+	Prefixes map[int64]string
+	Sha256   string `json:",omitempty"`
+}
+
+/* The sizes of the files in the stash, the prefix hashes to take on
+   the way through an incoming file. Published by the stash go
+   routine whenever the stash changes. */
+var (
+	checkpoint_mu sync.RWMutex
+	checkpoints   []int64
+)
+
+/* Don't take more prefix hashes than this, append falls back to
+   reading the staged file for any it's missing */
+const max_checkpoints = 1024
+
+func publishCheckpoints(files []Node) {
+	seen := map[int64]bool{}
+	var sizes []int64
+	for _, node := range files {
+		if node.Size > 0 && !seen[node.Size] && len(sizes) < max_checkpoints {
+			seen[node.Size] = true
+			sizes = append(sizes, node.Size)
+		}
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	checkpoint_mu.Lock()
+	checkpoints = sizes
+	checkpoint_mu.Unlock()
+}
+
+func currentCheckpoints() []int64 {
+	checkpoint_mu.RLock()
+	defer checkpoint_mu.RUnlock()
+	return checkpoints
+}
+
+/* Read src to the end, hashing it and copying it to dst on the way
+   when dst isn't nil. A prefix hash is taken every time we pass one
+   of the checkpoints, the SHA-256 only when sha is set. */
+func hashStream(dst io.Writer, src io.Reader, sha bool) (digest Digest, err error) {
+	sizes := currentCheckpoints()
+	var sha_hash hash.Hash
+	if sha {
+		sha_hash = sha256.New()
+	}
+	hash := md5.New()
+	buff := make([]byte, 64*1024)
+	next := 0
+	started := time.Now()
+	digest.Prefixes = map[int64]string{}
+	for {
+		want := int64(len(buff))
+		if next < len(sizes) && sizes[next]-digest.Size < want {
+			want = sizes[next] - digest.Size
+		}
+		sz, rerr := src.Read(buff[:want])
+		if sz > 0 {
+			hash.Write(buff[:sz])
+			if sha_hash != nil {
+				sha_hash.Write(buff[:sz])
+			}
+			if dst != nil {
+				if _, err = dst.Write(buff[:sz]); err != nil {
+					return
+				}
+			}
+			digest.Size += int64(sz)
+			if next < len(sizes) && digest.Size == sizes[next] {
+				digest.Prefixes[digest.Size] = fmt.Sprintf("%x", hash.Sum(nil))
+				next++
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return digest, rerr
+		}
+	}
+	//a prefix as long as the whole file is no prefix at all
+	delete(digest.Prefixes, digest.Size)
+	digest.ChkSum = fmt.Sprintf("%x", hash.Sum(nil))
+	if sha_hash != nil {
+		digest.Sha256 = fmt.Sprintf("%x", sha_hash.Sum(nil))
+	}
+	metrics.Hashed(digest.Size, time.Since(started))
+	return
+}
+
+/* Copy a dropped file into staging when it can't be renamed there,
+   the drop location is on another file system. The copy is the pass
+   that hashes it, sha as for hashStream. It's written to <id>.part
+   and only renamed to <id> once it's synced, so a crash part way
+   through never leaves a half copy for the journal to replay. */
+func copyToStaging(name string, staged string, sha bool) (digest Digest, err error) {
+	src, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+	part := staged + ".part"
+	dst, err := os.OpenFile(part, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	log.Debugln("Copying", name, "into staging across file systems")
+	digest, err = hashStream(dst, src, sha)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(part, staged)
+	}
+	if err != nil {
+		os.Remove(part)
+		return
+	}
+	err = os.Remove(name)
+	return
+}
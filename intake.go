@@ -0,0 +1,226 @@
+package main
+
+/*-----------------------------------------------
+ intake.go
+
+ Fair queueing of staged files between the
+ monitors and the stash
+-----------------------------------------------*/
+import (
+	"path"
+	"sort"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/* Intake sits between the monitors and the hash pool. Every
+   location gets its own FIFO of staged files, and the dispatcher
+   hands them to the pool round robin, one location
+   at a time. That way a single noisy drop location can't starve
+   the others, and monitors never block on the stash while it's
+   busy hashing.
+   Intake can be paused for a location, or for all of them under the
+   empty location. Monitors leave files in the drop locations while
+   paused and anything already queued waits in staging. */
+type Intake struct {
+	mu     sync.Mutex
+	queues map[string][]Operation
+	order  []string
+	next   int
+	ready  chan bool
+	paused map[string]bool
+	exited chan bool
+}
+
+/* Initialize the queues, must be called before the monitors
+   start submitting files */
+func (self *Intake) init() {
+	self.queues = make(map[string][]Operation)
+	self.ready = make(chan bool, 1)
+	self.paused = make(map[string]bool)
+	self.exited = make(chan bool)
+}
+
+/* Queue a staged file for the stash */
+func (self *Intake) Submit(op Operation) {
+	self.mu.Lock()
+	if _, ok := self.queues[op.Location]; !ok {
+		self.order = append(self.order, op.Location)
+	}
+	self.queues[op.Location] = append(self.queues[op.Location], op)
+	self.mu.Unlock()
+	metrics.Pickup(op.Location)
+	self.wake()
+}
+
+/* Wake the dispatcher, if it's already awake that's fine too */
+func (self *Intake) wake() {
+	select {
+	case self.ready <- true:
+	default:
+	}
+}
+
+/* Is location one files come in from; a watched directory, an SFTP
+   tenant's sftp:<tenant> or the HTTP upload location */
+func intakeLocation(location string) bool {
+	if location == conf().Upload_location {
+		return true
+	}
+	for _, client := range conf().Sftp_clients {
+		if location == "sftp:"+client.Tenant {
+			return true
+		}
+	}
+	for _, watched := range conf().Locations {
+		if path.Clean(watched) == path.Clean(location) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Is intake from location paused */
+func (self *Intake) Paused(location string) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.paused[""] || self.paused[path.Clean(location)]
+}
+
+/* The paused locations, an empty location means all of them */
+func (self *Intake) PausedList() (list []string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for loc := range self.paused {
+		list = append(list, loc)
+	}
+	sort.Strings(list)
+	return
+}
+
+/* Pause or resume intake from location, or from every location when
+   it's empty. Resuming everything clears the pauses on single
+   locations too. Only the stash go routine does this, on a Pause or
+   Resume operation. */
+func (self *Intake) setPaused(location string, paused bool) {
+	if location != "" {
+		location = path.Clean(location)
+	}
+	self.mu.Lock()
+	switch {
+	case paused:
+		self.paused[location] = true
+	case location == "":
+		self.paused = make(map[string]bool)
+	default:
+		delete(self.paused, location)
+	}
+	self.mu.Unlock()
+
+	what := location
+	if what == "" {
+		what = "every location"
+	}
+	if paused {
+		log.Infoln("Intake paused for", what)
+		return
+	}
+	log.Infoln("Intake resumed for", what)
+	self.wake()    //release whatever waited in staging
+	requestSweep() //and pick up what was left in the drop locations
+}
+
+/* Take the next operation, moving on to the next location every
+   time so each location gets its turn */
+func (self *Intake) pop() (op Operation, ok bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.paused[""] {
+		return
+	}
+	for range self.order {
+		if self.next >= len(self.order) {
+			self.next = 0
+		}
+		loc := self.order[self.next]
+		self.next++
+		if q := self.queues[loc]; len(q) > 0 && !self.paused[path.Clean(loc)] {
+			op = q[0]
+			self.queues[loc] = q[1:]
+			return op, true
+		}
+	}
+	return
+}
+
+/* Pending returns the number of files waiting on the stash */
+func (self *Intake) Pending() (count int) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for _, q := range self.queues {
+		count += len(q)
+	}
+	return
+}
+
+/* Ready returns the number of files waiting on the stash that
+   aren't held back by a pause */
+func (self *Intake) Ready() (count int) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.paused[""] {
+		return 0
+	}
+	for loc, q := range self.queues {
+		if !self.paused[path.Clean(loc)] {
+			count += len(q)
+		}
+	}
+	return
+}
+
+/* Queued returns what's waiting on the stash */
+func (self *Intake) Queued() (ops []Operation) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for _, loc := range self.order {
+		ops = append(ops, self.queues[loc]...)
+	}
+	return
+}
+
+/* Put an operation back at the front of its queue */
+func (self *Intake) requeue(op Operation) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.queues[op.Location] = append([]Operation{op}, self.queues[op.Location]...)
+}
+
+/* The dispatcher runs as its own go routine and feeds the hash
+   pool one operation at a time, until the daemon quits. exited is
+   closed once it has put back what it was holding. */
+func (self *Intake) dispatch() {
+	log.Infoln("Intake dispatcher started")
+	defer close(self.exited)
+	for {
+		select {
+		case <-self.ready:
+		case <-quitting:
+			return
+		}
+		for {
+			op, ok := self.pop()
+			if !ok {
+				break
+			}
+			log.Debugln("Dispatching", op.Name, "from", op.Location, "to the hash pool")
+			select {
+			case pool.work <- op:
+			case <-quitting:
+				self.requeue(op)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+/*-----------------------------------------------
+ journal.go
+
+ Durable record of the files on their way into
+ the stash, so a crash can't lose them
+-----------------------------------------------*/
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/* JournalEntry is one line of the journal. An add is written before
+   a file is moved into staging, a done once the stash has the file.
+   Anything added but never done is replayed when the daemon starts.
+   A file copied into staging is added again with its Digest. What a
+   sidecar declared for the file goes along in Declared, the
+   delivery it joined in Delivery, and when it was picked up in
+   Picked. */
+type JournalEntry struct {
+	Op        string
+	Id        string
+	Name      string     `json:",omitempty"`
+	Location  string     `json:",omitempty"`
+	Overwrite bool       `json:",omitempty"`
+	Digest    *Digest    `json:",omitempty"`
+	Declared  *Declared  `json:",omitempty"`
+	Delivery  string     `json:",omitempty"`
+	Picked    *time.Time `json:",omitempty"`
+	Date      time.Time
+}
+
+/* Journal is the append only file Config_loc/journal, JSON lines.
+   - pending are the adds without a done, kept to compact the file
+   - order is the ids of pending in the order they were first added,
+     compaction keeps it so a replay stashes files in the order they
+     came in
+   - lines counts what's been written since the last compaction */
+type Journal struct {
+	mu      sync.Mutex
+	fl      *os.File
+	pending map[string]JournalEntry
+	order   []string
+	lines   int
+}
+
+/* Compact the journal once it has this many lines */
+const journal_compact_lines = 1000
+
+func journalFile() string {
+	return conf().Config_loc + "/journal"
+}
+
+/* Open the journal, returning whatever was pending when the last
+   daemon stopped. Must be called before the monitors start. */
+func (self *Journal) open() (pending []JournalEntry, err error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.pending = make(map[string]JournalEntry)
+	self.order = nil
+	if fl, err := os.Open(journalFile()); err == nil {
+		scanner := bufio.NewScanner(fl)
+		for scanner.Scan() {
+			var ent JournalEntry
+			if err := json.Unmarshal(scanner.Bytes(), &ent); err != nil {
+				//a torn last line, the add was never fully written
+				log.Warnln("Skipping unreadable journal entry:", err)
+				continue
+			}
+			switch ent.Op {
+			case "add":
+				if _, ok := self.pending[ent.Id]; !ok {
+					self.order = append(self.order, ent.Id)
+				}
+				self.pending[ent.Id] = ent
+			case "done":
+				delete(self.pending, ent.Id)
+			}
+		}
+		fl.Close()
+	}
+	err = self.compact()
+	for _, id := range self.order {
+		pending = append(pending, self.pending[id])
+	}
+	return
+}
+
+/* Rewrite the journal with only the pending entries, in order */
+func (self *Journal) compact() error {
+	var order []string
+	for _, id := range self.order {
+		if _, ok := self.pending[id]; ok {
+			order = append(order, id)
+		}
+	}
+	self.order = order
+
+	tmp := journalFile() + ".new"
+	fl, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(fl)
+	for _, id := range self.order {
+		if err = enc.Encode(self.pending[id]); err != nil {
+			fl.Close()
+			return err
+		}
+	}
+	if err = fl.Sync(); err == nil {
+		err = os.Rename(tmp, journalFile())
+	}
+	fl.Close()
+	if err != nil {
+		return err
+	}
+	if self.fl != nil {
+		self.fl.Close()
+	}
+	self.fl, err = os.OpenFile(journalFile(), os.O_WRONLY|os.O_APPEND, 0600)
+	self.lines = len(self.pending)
+	return err
+}
+
+func (self *Journal) write(ent JournalEntry, sync bool) error {
+	if self.fl == nil {
+		return errors.New("The journal isn't open")
+	}
+	bts, err := json.Marshal(ent)
+	if err != nil {
+		return err
+	}
+	if _, err = self.fl.Write(append(bts, '\n')); err != nil {
+		return err
+	}
+	self.lines++
+	if sync {
+		return self.fl.Sync()
+	}
+	return nil
+}
+
+/* Record a file on its way into the stash, this has to be on disk
+   before the file is moved into staging */
+func (self *Journal) Add(op Operation) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	ent := JournalEntry{"add", op.Id, op.Name, op.Location, op.Overwrite, op.digest, op.declared, op.delivery, &op.picked, time.Now()}
+	if err := self.write(ent, true); err != nil {
+		return err
+	}
+	if _, ok := self.pending[op.Id]; !ok {
+		self.order = append(self.order, op.Id)
+	}
+	self.pending[op.Id] = ent
+	return nil
+}
+
+/* Record that the stash is done with a file. Losing a done only
+   means the replay finds nothing left in staging, so there is no
+   need to sync it. */
+func (self *Journal) Done(id string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if _, ok := self.pending[id]; !ok {
+		return
+	}
+	delete(self.pending, id)
+	if err := self.write(JournalEntry{Op: "done", Id: id, Date: time.Now()}, false); err != nil {
+		log.Errorln("Failed to write to the journal:", err)
+		return
+	}
+	if self.lines >= journal_compact_lines {
+		if err := self.compact(); err != nil {
+			log.Errorln("Failed to compact the journal:", err)
+		}
+	}
+}
+
+/* Open the journal and hand anything left over from the last run
+   back to intake. Entries whose file never made it into staging are
+   dropped, the file is still in its drop location. */
+func (self *Journal) replay() {
+	pending, err := self.open()
+	if err != nil {
+		log.Errorln("Unable to open the journal:", err)
+	}
+	for _, ent := range pending {
+		os.Remove(conf().Staging_loc + "/" + ent.Id + ".part") //a copy cut short, the original is still in place
+		if _, err := os.Stat(conf().Staging_loc + "/" + ent.Id); err != nil {
+			log.Warnln("Journal entry for", ent.Name, "from", ent.Location, "has nothing in staging, dropping it")
+			self.Done(ent.Id)
+			continue
+		}
+		log.Infoln("Replaying", ent.Name, "from", ent.Location, "left in staging by the last run")
+		var picked time.Time
+		if ent.Picked != nil {
+			picked = *ent.Picked
+		}
+		intake.Submit(Operation{Code: ProcessFile, Id: ent.Id, Name: ent.Name, Location: ent.Location, Overwrite: ent.Overwrite,
+			digest: ent.Digest, declared: ent.Declared, delivery: ent.Delivery, picked: picked})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+/*-----------------------------------------------
+ limit.go
+
+ Token bucket rate limiting for the monitored
+ drop locations
+-----------------------------------------------*/
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/* RateLimit describes how fast a single drop location may feed
+   the stash:
+   - Files_per_second is the sustained number of pickups allowed
+   - Bytes_per_second is the sustained number of bytes allowed
+   - Mute_seconds is how long a location is ignored once it goes
+     over either limit. Files dropped while muted are left where
+     they are and swept up when the mute expires.
+   A zero rate means unlimited. */
+type RateLimit struct {
+	Files_per_second float64
+	Bytes_per_second float64
+	Mute_seconds     time.Duration
+}
+
+/* A classic token bucket. The bucket holds at most one second
+   worth of tokens and is allowed to go into debt, so a single
+   file bigger than the byte rate still gets through when the
+   bucket is full. */
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+/* Refill the bucket for the time elapsed */
+func (self *bucket) refill(now time.Time) {
+	if self.last.IsZero() {
+		self.tokens = self.rate
+	} else {
+		self.tokens += now.Sub(self.last).Seconds() * self.rate
+		if self.tokens > self.rate {
+			self.tokens = self.rate
+		}
+	}
+	self.last = now
+}
+
+/* Could n tokens be taken; all n have to be there, or the bucket has
+   to be full for anything bigger than it holds */
+func (self *bucket) has(n float64) bool {
+	return self.rate <= 0 || self.tokens >= n || self.tokens >= self.rate
+}
+
+func (self *bucket) spend(n float64) {
+	if self.rate > 0 {
+		self.tokens -= n
+	}
+}
+
+/* Limiter keeps a pair of buckets per location and the time
+   until which a location is muted. */
+type Limiter struct {
+	mu    sync.Mutex
+	files map[string]*bucket
+	bytes map[string]*bucket
+	muted map[string]time.Time
+}
+
+/* Look up the limit for a location, per location limits in the
+   config win over the default one */
+func limitFor(location string) RateLimit {
+	if lim, ok := conf().Location_limits[location]; ok {
+		return lim
+	}
+	return conf().Rate_limit
+}
+
+/* Allow reports whether a file of size bytes may be picked up
+   from location right now. When the location goes over its
+   limit it is muted and the returned duration is how long the
+   caller should wait before sweeping the location again. */
+func (self *Limiter) Allow(location string, size int64) (ok bool, wait time.Duration) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.files == nil {
+		self.files = make(map[string]*bucket)
+		self.bytes = make(map[string]*bucket)
+		self.muted = make(map[string]time.Time)
+	}
+	now := time.Now()
+	if until, ok := self.muted[location]; ok {
+		if now.Before(until) {
+			return false, until.Sub(now)
+		}
+		delete(self.muted, location)
+		log.Infoln("Un-muting location:", location)
+	}
+
+	lim := limitFor(location)
+	fb := self.files[location]
+	if fb == nil {
+		fb = &bucket{}
+		self.files[location] = fb
+	}
+	bb := self.bytes[location]
+	if bb == nil {
+		bb = &bucket{}
+		self.bytes[location] = bb
+	}
+	fb.rate = lim.Files_per_second
+	bb.rate = lim.Bytes_per_second
+	//neither bucket is touched unless both have enough
+	fb.refill(now)
+	bb.refill(now)
+	if fb.has(1) && bb.has(float64(size)) {
+		fb.spend(1)
+		bb.spend(float64(size))
+		return true, 0
+	}
+
+	wait = lim.Mute_seconds * time.Second
+	if wait <= 0 {
+		wait = time.Second
+	}
+	self.muted[location] = now.Add(wait)
+	log.Warnf("ALERT: %s is over its rate limit (%.1f files/s, %.0f bytes/s), muting for %v",
+		location, lim.Files_per_second, lim.Bytes_per_second, wait)
+	return false, wait
+}
+
+/* Charge size bytes to location after the fact, for SFTP uploads
+   whose size is only known once the client closes them. The bytes
+   are taken even from an empty bucket, the debt mutes the location
+   on its next Allow until it's paid off. */
+func (self *Limiter) Charge(location string, size int64) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	bb := self.bytes[location]
+	if bb == nil { //Allow let the upload in, so this never happens
+		return
+	}
+	bb.rate = limitFor(location).Bytes_per_second
+	bb.refill(time.Now())
+	bb.spend(float64(size))
+}
+
+/* Muted reports whether a location is currently muted */
+func (self *Limiter) Muted(location string) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	until, ok := self.muted[location]
+	return ok && time.Now().Before(until)
+}
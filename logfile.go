@@ -0,0 +1,179 @@
+package main
+
+/*-----------------------------------------------
+ logfile.go
+
+ The daemon's log file, with rotation, archive
+ compression and clean up
+-----------------------------------------------*/
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/* LogFile is what the daemon logs to, Log_loc/current. It is rolled
+   over every Log_roll days, or once it grows past Log_max_mb,
+   whichever comes first. Rolled over logs are archived next to it as
+   dropstash-<date>.log, gzipped when Log_compress is set, and only
+   the newest Log_archives are kept. Setting any of these to 0 turns
+   that part off.
+   - rolled is when the log was last rolled over, the date of the
+     newest archive on start */
+type LogFile struct {
+	mu     sync.Mutex
+	fl     *os.File
+	dir    string
+	size   int64
+	rolled time.Time
+}
+
+const archive_layout = "20060102-150405"
+
+func (self *LogFile) name() string {
+	return self.dir + "/current"
+}
+
+/* Open the log in Log_loc, appending to what's there */
+func (self *LogFile) open() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.reopen()
+}
+
+func (self *LogFile) reopen() error {
+	self.dir = conf().Log_loc
+	fl, err := os.OpenFile(self.name(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	if self.fl != nil {
+		self.fl.Close()
+	}
+	self.fl = fl
+	self.size = 0
+	if st, err := fl.Stat(); err == nil {
+		self.size = st.Size()
+	}
+	self.rolled = time.Now()
+	if archives := self.archives(); len(archives) > 0 {
+		if st, err := os.Stat(archives[len(archives)-1]); err == nil {
+			self.rolled = st.ModTime()
+		}
+	}
+	//anything written to stdout or stderr, a panic say, goes to the
+	//log too
+	syscall.Dup3(int(fl.Fd()), 1, 0)
+	syscall.Dup3(int(fl.Fd()), 2, 0)
+	return nil
+}
+
+/* Reopen the log, after something else like logrotate moved it or
+   Log_loc changed */
+func (self *LogFile) Reopen() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.reopen()
+}
+
+/* The archived logs, oldest first */
+func (self *LogFile) archives() []string {
+	archives, _ := filepath.Glob(self.dir + "/dropstash-*.log*")
+	sort.Strings(archives)
+	return archives
+}
+
+func (self *LogFile) due() bool {
+	if conf().Log_max_mb > 0 && self.size >= conf().Log_max_mb*1024*1024 {
+		return true
+	}
+	return conf().Log_roll > 0 && time.Since(self.rolled) >= time.Duration(conf().Log_roll)*24*time.Hour
+}
+
+func (self *LogFile) Write(p []byte) (n int, err error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.fl == nil {
+		return os.Stderr.Write(p)
+	}
+	if self.due() {
+		self.roll()
+	}
+	n, err = self.fl.Write(p)
+	self.size += int64(n)
+	return
+}
+
+/* Roll the log over, we keep writing to the old file if we can't */
+func (self *LogFile) roll() {
+	archive := self.dir + "/dropstash-" + time.Now().Format(archive_layout) + ".log"
+	if err := os.Rename(self.name(), archive); err != nil {
+		self.rolled = time.Now() //don't try again on every line
+		return
+	}
+	if err := self.reopen(); err != nil {
+		self.fl.Write([]byte("Unable to open a new log after rolling over: " + err.Error() + "\n"))
+		return
+	}
+	self.rolled = time.Now()
+	go archiveLog(archive, self.dir)
+}
+
+/* Compress a rolled over log and clean up the old ones */
+func archiveLog(archive string, dir string) {
+	if conf().Log_compress {
+		if err := gzipFile(archive); err != nil {
+			log.Errorln("Unable to compress", archive, ":", err)
+		}
+	}
+	if conf().Log_archives <= 0 {
+		return
+	}
+	archives, _ := filepath.Glob(dir + "/dropstash-*.log*")
+	sort.Strings(archives)
+	for len(archives) > conf().Log_archives {
+		os.Remove(archives[0])
+		archives = archives[1:]
+	}
+}
+
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
+
+/* SIGUSR1 reopens the log, for logrotate and friends */
+func reopenHandler(sig os.Signal) error {
+	if err := logfile.Reopen(); err != nil {
+		log.Errorln("Unable to reopen the log:", err)
+	} else {
+		log.Infoln("Log reopened")
+	}
+	return nil
+}
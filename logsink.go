@@ -0,0 +1,179 @@
+package main
+
+/*-----------------------------------------------
+ logsink.go
+
+ Log format and where the daemon's log goes;
+ its file, syslog and the systemd journal
+-----------------------------------------------*/
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/sevlyar/go-daemon"
+)
+
+/* Where the systemd journal takes native protocol messages */
+const journald_socket = "/run/systemd/journal/socket"
+
+/* LogSinks sends every log entry on to syslog and the journal when
+   Log_sinks asks for them, it's a logrus.Hook. The file sink is
+   logrus' own output. */
+type LogSinks struct {
+	mu      sync.Mutex
+	syslog  *syslog.Writer
+	journal net.Conn
+}
+
+func (self *LogSinks) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (self *LogSinks) Fire(entry *log.Entry) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.syslog != nil {
+		line, err := entry.String()
+		if err == nil {
+			err = toSyslog(self.syslog, entry.Level, strings.TrimSpace(line))
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to log to syslog:", err)
+		}
+	}
+	if self.journal != nil {
+		if _, err := self.journal.Write(journalMessage(entry)); err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to log to the journal:", err)
+		}
+	}
+	return nil
+}
+
+func toSyslog(w *syslog.Writer, level log.Level, line string) error {
+	switch level {
+	case log.PanicLevel:
+		return w.Emerg(line)
+	case log.FatalLevel:
+		return w.Crit(line)
+	case log.ErrorLevel:
+		return w.Err(line)
+	case log.WarnLevel:
+		return w.Warning(line)
+	case log.InfoLevel:
+		return w.Info(line)
+	}
+	return w.Debug(line)
+}
+
+/* Encode an entry in the journal's native protocol, KEY=value lines
+   with the fields of the entry upper cased. Values spanning lines
+   are sent as the key, a newline, their length and the value. */
+func journalMessage(entry *log.Entry) []byte {
+	priority := map[log.Level]int{log.PanicLevel: 0, log.FatalLevel: 2, log.ErrorLevel: 3, log.WarnLevel: 4, log.InfoLevel: 6}
+	prio, ok := priority[entry.Level]
+	if !ok {
+		prio = 7
+	}
+	var buf bytes.Buffer
+	field := func(key string, value string) {
+		if !strings.Contains(value, "\n") {
+			fmt.Fprintf(&buf, "%s=%s\n", key, value)
+			return
+		}
+		buf.WriteString(key + "\n")
+		binary.Write(&buf, binary.LittleEndian, uint64(len(value)))
+		buf.WriteString(value + "\n")
+	}
+	field("MESSAGE", entry.Message)
+	field("PRIORITY", fmt.Sprint(prio))
+	field("SYSLOG_IDENTIFIER", "dropstash")
+	for key, value := range entry.Data {
+		field(journalKey(key), fmt.Sprint(value))
+	}
+	return buf.Bytes()
+}
+
+/* Journal field names are upper case letters, digits and
+   underscores, and can't start with an underscore */
+func journalKey(key string) string {
+	key = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	return "DROPSTASH_" + strings.TrimLeft(key, "_")
+}
+
+/* Connect to and disconnect from syslog and the journal to match
+   Log_sinks */
+func (self *LogSinks) apply() {
+	want := map[string]bool{}
+	for _, sink := range conf().Log_sinks {
+		want[sink] = true
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	var err error
+	switch {
+	case want["syslog"] && self.syslog == nil:
+		if self.syslog, err = syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "dropstash"); err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to connect to syslog:", err)
+		}
+	case !want["syslog"] && self.syslog != nil:
+		self.syslog.Close()
+		self.syslog = nil
+	}
+	switch {
+	case want["journald"] && self.journal == nil:
+		if self.journal, err = net.Dial("unixgram", journald_socket); err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to connect to the journal:", err)
+		}
+	case !want["journald"] && self.journal != nil:
+		self.journal.Close()
+		self.journal = nil
+	}
+}
+
+/* Apply the log settings from the config; level, format and sinks.
+   -debug wins over Log_level. */
+func applyLogging() {
+	if *debug {
+		log.SetLevel(log.DebugLevel)
+	} else if level, err := log.ParseLevel(conf().Log_level); err != nil {
+		log.Warnln("Invalid Log_level", conf().Log_level, "- keeping", log.GetLevel())
+	} else {
+		log.SetLevel(level)
+	}
+
+	if conf().Log_format == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	} else {
+		log.SetFormatter(&log.TextFormatter{})
+	}
+
+	to_file := false
+	for _, sink := range conf().Log_sinks {
+		to_file = to_file || sink == "file"
+	}
+	switch {
+	case !to_file:
+		log.SetOutput(ioutil.Discard)
+	case daemon.WasReborn():
+		log.SetOutput(&logfile)
+	default:
+		log.SetOutput(os.Stderr)
+	}
+	log_sinks.apply()
+}
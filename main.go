@@ -8,29 +8,40 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"os/exec"
 	"regexp"
 	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/sevlyar/go-daemon"
 )
 
 var (
-	config       Config
-	meta         Meta
-	signal       *string
-	cmd_args     []string
-	invalid      = "invalid"
-	as_daemon    = flag.Bool("d", false, `when combined with start, run as a system daemon`)
-	debug        = flag.Bool("debug", false, `Turn on debug level logging`)
-	mon_notifier = make(chan bool)
+	meta       Meta
+	intake     Intake
+	limiter    Limiter
+	disk       DiskWatch
+	metrics    Metrics
+	logfile    LogFile
+	log_sinks  LogSinks
+	audit      Audit
+	deliveries Deliveries
+	journal    Journal
+	pool       HashPool
+	error_log  ErrorLog
+	started    time.Time
+	signal     *string
+	cmd_args   []string
+	invalid    = "invalid"
+	as_daemon  = flag.Bool("d", false, `when combined with start, run as a system daemon`)
+	debug      = flag.Bool("debug", false, `Turn on debug level logging`)
 )
 
 //go:generate /bin/bash -c "./build_dependencies.sh"
 func main() {
 
 	flag.Parse()
+	metrics.init()
 
 	if *debug {
 		log.SetLevel(log.DebugLevel)
@@ -43,8 +54,8 @@ func main() {
 		signal = &invalid
 	}
 
-	if match, err := regexp.MatchString("start|stop|reload|status|remove|list|export", *signal); !match || err != nil {
-		log.Errorln("Must provide at at least one command (start, stop, reload, status, remove, list, export)")
+	if match, err := regexp.MatchString("start|stop|reload|status|remove|list|export|retention|hold|release|trash|pause|resume|audit|receipt", *signal); !match || err != nil {
+		log.Errorln("Must provide at at least one command (start, stop, reload, status, remove, list, export, retention, hold, release, trash, pause, resume, audit, receipt)")
 		fmt.Println("Optional flags:")
 		flag.PrintDefaults()
 		os.Exit(1)
@@ -55,21 +66,22 @@ func main() {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
-	config.LoadConfig()
-	if len(config.Locations) < 1 && *signal == "start" {
+	new(Config).LoadConfig()
+	if len(conf().Locations) < 1 && *signal == "start" {
 		log.Fatal("Must have one or more locatoins to monitor. Please edit config file")
 	}
 
 	daemon.AddCommand(daemon.StringFlag(signal, "stop"), syscall.SIGTERM, termHandler)
 	daemon.AddCommand(daemon.StringFlag(signal, "reload"), syscall.SIGHUP, reloadHandler)
 	daemon.SetSigHandler(termHandler, syscall.SIGINT)
+	daemon.SetSigHandler(reopenHandler, syscall.SIGUSR1)
 
 	cntxt := &daemon.Context{
-		PidFileName: (config.Config_loc + "/pid"),
+		PidFileName: (conf().Config_loc + "/pid"),
 		PidFilePerm: 0640,
-		LogFileName: (config.Log_loc + "/current"),
+		LogFileName: (conf().Log_loc + "/current"),
 		LogFilePerm: 0640,
-		WorkDir:     config.Config_loc,
+		WorkDir:     conf().Config_loc,
 		Umask:       027,
 		Args:        []string{"[dropstash-daemon]", "start"},
 	}
@@ -84,50 +96,12 @@ func main() {
 		return
 	}
 	switch {
-	case *signal == "status":
-		cmd := "/bin/ps -ef | /bin/egrep 'dropstash |dropstash\\-daemon' | /bin/egrep -v 'grep|status'"
-		out, err := exec.Command("/bin/sh", "-c", cmd).Output()
-		if err != nil {
-			fmt.Printf("\nDropstash daemon not running, please start.\n\n")
-		} else {
-			fmt.Printf("\nDropstash running:\n%s\n", out)
-		}
-	case *signal == "list":
-		meta.LoadStashFile()
-		const layout = "Jan 02 06 15:04:23"
-		/*TODO; this would be a perfect fit for text/templates*/
-		for _, node := range meta.Files {
-			for _, file := range node.Pointers {
-				nm := file.Name
-				if len(file.Name) > 30 {
-					nm = file.Name[:27] + "..."
-				}
-				np := file.Location
-				if len(file.Location) > 35 {
-					np = file.Location[:32] + "..."
-				}
-				fmt.Printf("%-36s %-30s %10d %3d %-40s %v\n",
-					node.Id, nm, file.Size, file.Version, np, file.VersionDate.Format(layout))
-			}
-		}
-	case *signal == "export":
-		meta.LoadStashFile()
-		log.Debugln("Length of args is:", len(cmd_args))
-		if len(cmd_args) != 2 {
-			log.Fatalln("Copy requires both a source and a destination")
-			os.Exit(1)
-		}
-		node, file, _ := meta.Lookup(cmd_args[0])
-		log.Debugln("node:\n", node, "\nFile:\n", file)
-		log.Debugln("output file:", cmd_args[1])
-		meta.ExportFile(*node, *file, cmd_args[1])
-
-	case *signal == "remove":
-		meta.LoadStashFile()
-		log.Debugln("Length of args is:", len(cmd_args))
-		for itr := 0; itr < len(cmd_args); itr++ {
-			meta.RemoveFile(cmd_args[itr])
+	case *signal != "start" && *signal != "status":
+		if err := runCommand(*signal, cmd_args); err != nil {
+			log.Fatalln(err)
 		}
+	case *signal == "status":
+		os.Exit(runStatus(cmd_args))
 	case *signal == "start":
 
 		if *as_daemon { //if we flaged daemon, we do our fork
@@ -145,16 +119,37 @@ func main() {
 			}
 		}
 		defer cntxt.Release()
+		new(Config).LoadConfig() //must reload since we are in a child process
+		if daemon.WasReborn() {  //take the log over from go-daemon, so we can roll it
+			if err := logfile.open(); err != nil {
+				log.Errorln("Unable to open the log:", err)
+			}
+		}
+		log.AddHook(&log_sinks)
+		applyLogging()
 		log.Infoln("- - - - - - - - - - - - - - -")
 		log.Infoln("daemon started")
-		config.LoadConfig() //must reload since we are in a child process
+		started = time.Now()
 		log.Infoln("Loaded config")
+		log.AddHook(&metrics)
+		log.AddHook(&error_log)
 		meta.init()
+		intake.init()
+		pool.init()
+		journal.replay()
 
 		go meta.OpenStash()
-		for itr := 0; itr < len(config.Locations); itr++ {
-			go monitor(itr, mon_notifier)
-		} //*/
+		pool.start()
+		go intake.dispatch()
+		go disk.watch()
+		go serveControl()
+		defer os.Remove(conf().Control_socket)
+		go serveHttp()
+		go serveSftp()
+		go watchConfig()
+		for _, location := range conf().Locations {
+			startMonitor(location, false)
+		}
 
 		err := daemon.ServeSignals()
 		if err != nil {
@@ -167,25 +162,13 @@ func main() {
 func termHandler(sig os.Signal) error {
 
 	log.Println("Cleaning up...")
-	if sig == syscall.SIGTERM ||
-		sig == syscall.SIGINT {
-		stopOp := new(Operation)
-		stopOp.Code = Stop
-		meta.stash <- *stopOp
-	}
-	<-meta.stash
-
+	shutdown()
 	return daemon.ErrStop
 }
 
 func reloadHandler(sig os.Signal) error {
-	for range config.Locations {
-		mon_notifier <- true
+	if reload("SIGHUP") == nil {
+		log.Println("configuration reloaded")
 	}
-	config.LoadConfig()
-	for itr := 0; itr < len(config.Locations); itr++ {
-		go monitor(itr, mon_notifier)
-	} //*/
-	log.Println("configuration reloaded")
 	return nil
 }
@@ -9,6 +9,7 @@ package main
 import (
 	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -35,13 +36,22 @@ import (
    In this way we optamize the bytes stored in the stash and
    keep all versions of any given file transfered until removed
    from the stash. A Node remains in the stash until all File
-   pointers are exhausted, then frees the longest portion remaining.*/
+   pointers are exhausted, then frees the longest portion remaining.
+
+   Verify is what came of checking the file against the checksum
+   its sender declared in a sidecar; verified, mismatch or
+   unverified when there was none. A mismatch is stashed all the
+   same, flagged as corrupt. Delivery is the id of the batch the
+   file was dropped with, see Deliveries. */
 type FilePointer struct {
 	Name        string
 	Location    string
 	Size        int64
 	VersionDate time.Time
 	Version     int
+	Hold        *Hold
+	Verify      string `json:",omitempty"`
+	Delivery    string `json:",omitempty"`
 }
 
 /* Interface used to compare File Pointers to each other */
@@ -95,6 +105,7 @@ type LookupPointer struct {
      replace it with the new file... not currently implemented
    - MaxSize, is the largest FilePointer.Size in Names, allowing
      optamization and truncation if bytes are removed from a Node.
+   - Hold is set while the whole node is under a legal hold
    In order for partial processing to be accurate, files must be marked
    as being transfered with overwrite if the sender intends to send an
    identical file with less bytes. */
@@ -106,6 +117,7 @@ type Node struct {
 	PickupCount  int
 	PartialCount int
 	Overwrite    bool
+	Hold         *Hold
 }
 
 /* Interface used to compare File Pointers to each other */
@@ -123,6 +135,9 @@ func (self *Node) Compare(to *Node) (ret bool) {
    to the Meta stash.
    - ProcessFile contains the file to process,
    - start and stop are the control structures for the channel
+   - pause and resume hold back intake from Location, or from every
+     location when Location is empty
+   - Control runs a request from the control socket on the stash
    - Use go generate to generate the opcode_string.go file*/
 //go:generate stringer -type=OpCode
 type OpCode int
@@ -132,16 +147,30 @@ const (
 	ProcessFile
 	Stop
 	Pause
+	Control
+	Resume
 )
 
 /* Operation passed along the channel to the stash. This is used for
-   communication between the monitor and the stash thread */
+   communication between the monitor and the stash thread. A Control
+   operation carries the call to make, and where to send its result
+   when done is set. A ProcessFile operation carries the staged file,
+   opened and hashed by the hash pool, and its digest. picked is when
+   the file was picked up, the date its version gets */
 type Operation struct {
 	Code      OpCode
 	Name      string
 	Location  string
 	Id        string
 	Overwrite bool
+	call      func(*Meta) error
+	done      chan error
+	node      *Node
+	file      *os.File
+	digest    *Digest
+	declared  *Declared
+	delivery  string
+	picked    time.Time
 }
 
 /* The Meta struct contains the actual stash metadata:
@@ -149,13 +178,24 @@ type Operation struct {
    - Count is a cash of the total number of files that should be in the
     array. This is a convience value for readability within the file and
 	therefore is printed first within the file
+   - Trash holds whatever was removed and can still be restored
+   - lock and lock_depth track the meta lock, see lockMeta
+   - saved is the meta file as we last read or wrote it, so we can
+     tell when somebody else wrote it behind our back
+   - stopped is closed once the stash has stopped and saved, after
+     that nothing may be sent on stash
    The global var stash is used by the meta channel to maintain the live
    stash */
 type Meta struct {
-	Count    int
-	Files    []Node
-	pointers map[string]map[int]LookupPointer
-	stash    chan Operation
+	Count      int
+	Files      []Node
+	Trash      []TrashEntry
+	pointers   map[string]map[int]LookupPointer
+	stash      chan Operation
+	lock       *os.File
+	lock_depth int
+	saved      os.FileInfo
+	stopped    chan bool
 }
 
 /* Initialize our Meta object. This is necessary because we need the
@@ -164,12 +204,17 @@ func (self *Meta) init() {
 	log.Info("Initializing the stash channel")
 	self.pointers = make(map[string]map[int]LookupPointer)
 	self.stash = make(chan Operation) //make our channel, must be first
+	self.stopped = make(chan bool)
 
 }
 
 func (self *Meta) LoadStashFile() {
+	if err := self.lockMeta(); err != nil {
+		log.Warn(err) //files are swapped in whole, reading anyway is safe
+	}
+	defer self.unlockMeta()
 	//load the meta data
-	fl, err := os.OpenFile(config.Config_loc+"/meta", os.O_RDONLY|os.O_CREATE, 0600)
+	fl, err := os.OpenFile(conf().Config_loc+"/meta", os.O_RDONLY|os.O_CREATE, 0600)
 	if err != nil {
 		log.Warn(err)
 	}
@@ -178,6 +223,7 @@ func (self *Meta) LoadStashFile() {
 		log.Warn("Error parsing meta file: ", err)
 	}
 	fl.Close() //we keep going even on failure so we must close
+	self.saved, _ = os.Stat(conf().Config_loc + "/meta")
 	self.RebuildLookup()
 }
 
@@ -188,52 +234,56 @@ func (self *Meta) OpenStash() {
 
 	log.Info("Opening stash")
 	//check for ~/.dropstash
-	if _, err := os.Stat(config.Staging_loc); os.IsNotExist(err) {
-		log.Warnf("No existing stash: %s, creating", config.Stash_loc)
-		log.Warnf("No existing staging location: %s, creating", config.Staging_loc)
-		os.MkdirAll(config.Staging_loc, 0700)
+	if _, err := os.Stat(conf().Staging_loc); os.IsNotExist(err) {
+		log.Warnf("No existing stash: %s, creating", conf().Stash_loc)
+		log.Warnf("No existing staging location: %s, creating", conf().Staging_loc)
+		os.MkdirAll(conf().Staging_loc, 0700)
 	}
 
 	self.LoadStashFile()
 	log.Println("Loaded available meta data")
-	defer close(self.stash) //defer some cleanup
-	curr_op := Operation{}  //get the next operation... better be start
+	defer close(self.stopped) //anybody still sending gives up
+	curr_op := Operation{}    //get the next operation... better be start
+	housekeeping_every := conf().Retention_check_minutes
+	housekeeping := time.NewTicker(housekeeping_every * time.Minute)
+	defer func() { housekeeping.Stop() }()
 
 	for curr_op.Code != Stop {
 		log.Debugln("Processing opcodes and stash save")
+		if housekeeping_every != conf().Retention_check_minutes { //changed by a reload
+			housekeeping_every = conf().Retention_check_minutes
+			housekeeping.Stop()
+			housekeeping = time.NewTicker(housekeeping_every * time.Minute)
+		}
 		select { //get the next operation, and occasionally save the stash
 
-		case <-time.After(config.Stash_save_seconds * time.Second):
+		case <-time.After(conf().Stash_save_seconds * time.Second):
 			self.SaveStash()
+		case <-housekeeping.C:
+			if len(conf().Retention) > 0 {
+				self.ApplyRetention("retention")
+			}
+			self.ExpireTrash()
+			expireUploads()
 		case curr_op = <-self.stash:
 			log.Debugln("Processing next Operation:", curr_op.Code)
 			if curr_op.Code == ProcessFile {
-				fl, err := os.Open(config.Staging_loc + "/" + curr_op.Id)
-				if err != nil {
-					log.Errorln("Failed to open staging file:", curr_op.Id)
-					continue
+				//the hash pool did the hashing, we have a 'current file'
+				//and can append it to the stash
+				stashed, pointer := self.append(*curr_op.node, curr_op.file, curr_op.digest.Prefixes) //Note that fl is closed in append
+				journal.Done(curr_op.Id)
+				writeReceipt(stashed, pointer, curr_op.node.ChkSum)
+			} else if curr_op.Code == Control {
+				curr_op.done <- curr_op.call(self)
+			} else if curr_op.Code == Pause || curr_op.Code == Resume {
+				intake.setPaused(curr_op.Location, curr_op.Code == Pause)
+				if curr_op.done != nil {
+					curr_op.done <- nil
 				}
-				var file Node
-				file.Id = curr_op.Id
-				file.Overwrite = curr_op.Overwrite
-				if fd, err := fl.Stat(); err != nil {
-					log.Errorln("Failed to get stats on staged file:", file.Id)
-					continue
-				} else {
-					file.Size = fd.Size()
-				}
-				file.ChkSum, err = self.calcMd5sum(fl, file.Size)
-				file.PickupCount = 1
-				file.PartialCount = 0
-				pointer := FilePointer{curr_op.Name, curr_op.Location, file.Size, time.Now(), 0}
-				file.Pointers = append(file.Pointers, pointer)
-				//Now that we have a 'current file', we can append it to the stash
-				self.append(file, fl) //Note that fl is closed in append
 			}
 		}
 	}
 	self.SaveStash() //make sure we clean up
-	meta.stash <- curr_op
 }
 
 /* Calculate the md5 sum for reader x up to n bytes
@@ -242,6 +292,7 @@ func (self *Meta) calcMd5sum(in io.Reader, bc int64) (ret string, err error) {
 	hash := md5.New()
 	buff := make([]byte, 4096)
 	var soFar int64
+	started := time.Now()
 	stop := false
 	log.Debugln("incoming md5 request, ", bc, " bytes")
 	for {
@@ -274,30 +325,48 @@ func (self *Meta) calcMd5sum(in io.Reader, bc int64) (ret string, err error) {
 		ret = fmt.Sprintf("%x", bts)
 	}
 	log.Debugln("logged and hashed ", soFar, " bytes")
+	metrics.Hashed(soFar, time.Since(started))
 	return
 }
 
 /* De-duplicate staging / stash note this should be private to
-   Meta */
-func (self *Meta) append(stgNode Node, stgFile *os.File) {
+   Meta. prefixes are the hashes of the staged file cut down to the
+   size of each stash file, see Digest, the staged file is only read
+   again for any that are missing. Returns the stash the file ended
+   up in and its pointer there. */
+func (self *Meta) append(stgNode Node, stgFile *os.File, prefixes map[int64]string) (stashed string, pointer FilePointer) {
 
-	pointer := stgNode.Pointers[0] //there can only be one here!
+	pointer = stgNode.Pointers[0] //there can only be one here!
 	log.Debugln("A dump of our file so far:\n***\n %v\n\n***", stgNode)
+	if err := self.lockMeta(); err != nil {
+		log.Warnln(err, "- the stash will be saved later")
+	} else {
+		defer self.unlockMeta()
+	}
 	defer self.RebuildLookup() //we can do this nomatter what the outcome
 	defer self.SaveStash()
+	logged := func(outcome string, id string) *log.Entry { //audit it, then the fields log aggregators key on
+		audit.Record(AuditEntry{Event: "pickup", By: pointer.Location, Node: id, Name: pointer.Name,
+			Version: pointer.Version, Location: pointer.Location, Size: stgNode.Size, ChkSum: stgNode.ChkSum, Outcome: outcome,
+			Verify: pointer.Verify, Delivery: pointer.Delivery})
+		return log.WithFields(log.Fields{"event": "stash", "outcome": outcome, "node": id,
+			"name": pointer.Name, "location": pointer.Location, "size": stgNode.Size, "verify": pointer.Verify,
+			"delivery": pointer.Delivery})
+	}
 	for itr := range self.Files { //loop over everything in the stash if we have to
 		node := &self.Files[itr]
 		log.Debugln("Comparing to:", node.Id)
 		if node.ChkSum == stgNode.ChkSum { //we have a flat out duplicate
-			log.Info("Found a duplicate of ", node.Id)
-			pointer.Version = len(node.Pointers)
+			pointer.Version = self.nextVersion(node) //before the audit, it records the version
+			logged("duplicate", node.Id).Info("Found a duplicate of ", node.Id)
+			metrics.Outcome("duplicate", stgNode.Size)
 			node.Pointers = append(node.Pointers, pointer)
 			node.PickupCount += 1
 			stgFile.Close()
-			os.Remove(config.Staging_loc + "/" + stgNode.Id)
-			return
+			os.Remove(conf().Staging_loc + "/" + stgNode.Id)
+			return node.Id, pointer
 		}
-		stashfl, err := os.Open(config.Stash_loc + "/" + node.Id)
+		stashfl, err := os.Open(conf().Stash_loc + "/" + node.Id)
 		if err != nil {
 			log.Errorln("Failed to open stash file: ", node.Id)
 			break //TODO; is it possible that this could introduce a zombi?
@@ -306,36 +375,68 @@ func (self *Meta) append(stgNode Node, stgFile *os.File) {
 		stashfl.Close()
 		log.Debugln("LeftCheck for stgNode.size; ", stgNode.Size, " is: ", leftCheck)
 		if leftCheck == stgNode.ChkSum { //incoming file is a partial of this file
-			log.Info("Incoming file is a partial of: ", node.Id)
-			pointer.Version = len(node.Pointers)
+			pointer.Version = self.nextVersion(node)
+			logged("partial", node.Id).Info("Incoming file is a partial of: ", node.Id)
+			metrics.Outcome("partial", stgNode.Size)
 			node.Pointers = append(node.Pointers, pointer)
 			node.PartialCount += 1
 			stgFile.Close() //we only add the pointer and remove the staged file
-			os.Remove(config.Staging_loc + "/" + stgNode.Id)
-			return
+			os.Remove(conf().Staging_loc + "/" + stgNode.Id)
+			return node.Id, pointer
+		}
+		rightCheck, cached := prefixes[node.Size]
+		if node.Size >= stgNode.Size {
+			rightCheck = stgNode.ChkSum
+		} else if !cached {
+			stgFile.Seek(0, 0)
+			rightCheck, _ = self.calcMd5sum(stgFile, node.Size)
 		}
-		stgFile.Seek(0, 0)
-		rightCheck, _ := self.calcMd5sum(stgFile, node.Size)
 		log.Debugln("RightCheck for stgNode.size; ", stgNode.Size, " is: ", rightCheck)
 		if rightCheck == node.ChkSum { //stashed file is a partial of the incoming file
-			log.Info("Stashed file ", node.Id, " is a partial of incoming file")
-			pointer.Version = len(node.Pointers)
+			pointer.Version = self.nextVersion(node)
+			logged("extended", node.Id).Info("Stashed file ", node.Id, " is a partial of incoming file")
+			metrics.Outcome("extended", node.Size)
 			node.Pointers = append(node.Pointers, pointer)
 			node.PickupCount += 1
 			node.PartialCount += 1
 			stgFile.Close() //we keep the incoming file and ditch the staged file, keep the old id
-			os.Rename(config.Staging_loc+"/"+stgNode.Id, config.Stash_loc+"/"+node.Id)
+			os.Rename(conf().Staging_loc+"/"+stgNode.Id, conf().Stash_loc+"/"+node.Id)
 			node.Size = stgNode.Size
 			node.ChkSum = stgNode.ChkSum
-			return
+			return node.Id, pointer
 		}
 	} //stage file is unique to the stash, add and move
-	log.Info("New file is unique, adding to stash as", stgNode.Id)
+	logged("unique", stgNode.Id).Info("New file is unique, adding to stash as ", stgNode.Id)
+	metrics.Outcome("unique", 0)
 	stgFile.Close()
 	self.Files = append(self.Files, stgNode) // this happens if we are not a duplicate or partial
 	self.Count = len(self.Files)
-	os.Rename(config.Staging_loc+"/"+stgNode.Id, config.Stash_loc+"/"+stgNode.Id)
-	return
+	os.Rename(conf().Staging_loc+"/"+stgNode.Id, conf().Stash_loc+"/"+stgNode.Id)
+	return stgNode.Id, pointer
+}
+
+/* The version for the next pointer on node, one past the highest it
+   ever had. Retention and expiry remove old versions, counting the
+   pointers left would hand out a version that's still in use, or
+   one waiting in the trash to be restored. */
+func (self *Meta) nextVersion(node *Node) int {
+	next := 0
+	for _, fp := range node.Pointers {
+		if fp.Version >= next {
+			next = fp.Version + 1
+		}
+	}
+	for _, entry := range self.Trash {
+		if entry.Node.Id != node.Id {
+			continue
+		}
+		for _, fp := range entry.Node.Pointers {
+			if fp.Version >= next {
+				next = fp.Version + 1
+			}
+		}
+	}
+	return next
 }
 
 /* Save the current state of the stash. This will happen periodically
@@ -343,19 +444,48 @@ func (self *Meta) append(stgNode Node, stgFile *os.File) {
    - Use config.Stash_save_seconds to determine how long
 */
 func (self *Meta) SaveStash() {
-	fl, err := os.Create(config.Config_loc + "/meta")
-	if err != nil {
-		log.Fatal(err)
+	if err := self.lockMeta(); err != nil {
+		log.Errorln("Failed to save meta data:", err)
+		return
+	}
+	defer self.unlockMeta()
+	started := time.Now()
+
+	//somebody wrote the meta file since we last looked, keep their copy
+	//around rather than silently writing over it
+	name := conf().Config_loc + "/meta"
+	if st, err := os.Stat(name); err == nil && self.saved != nil &&
+		(st.ModTime() != self.saved.ModTime() || st.Size() != self.saved.Size()) {
+		conflict := fmt.Sprintf("%s.conflict-%d", name, time.Now().Unix())
+		log.Errorln("Meta data was changed by another process, saving their copy as", conflict)
+		os.Rename(name, conflict)
+	}
+
+	//write next to the meta file and swap it in, a full disk must never
+	//leave us with a truncated meta file
+	tmp := conf().Config_loc + "/meta.new"
+	fl, err := os.Create(tmp)
+	if err != nil { //most likely a full disk, keep running and try again next save
+		log.Errorln("Failed to save meta data:", err)
+		return
 	}
-	defer fl.Close()
 	st, err := json.MarshalIndent(&self, "", "    ")
 	if err != nil {
 		log.Errorln("Failed to open our meta data file", err)
 	}
 	_, err = fmt.Fprintf(fl, "%s", st)
+	fl.Close()
 	if err != nil {
 		log.Errorln("Failed to write meta data", err)
+		os.Remove(tmp)
+		return
+	}
+	if err = os.Rename(tmp, name); err != nil {
+		log.Errorln("Failed to replace meta data", err)
+		return
 	}
+	self.saved, _ = os.Stat(name)
+	metrics.Saved(time.Since(started))
 	log.Debugln("Saved meta data")
 }
 
@@ -393,7 +523,8 @@ func (self *Meta) RebuildLookup() {
 		}
 	}
 	log.Debugln(self.pointers)
-
+	publishCheckpoints(self.Files)
+	metrics.Stashed(self.Stats())
 }
 
 /* Do a lookup on the stash for a give stash node... format:
@@ -443,41 +574,53 @@ func (self *Meta) Lookup(stash_node string) (node *Node, file *FilePointer, exac
 
 /* Remove a version, file or stash from the stash format:
    {stashid}/<filename><:version>
-   will remove everything if asked */
-func (self *Meta) RemoveFile(stash_node string) {
+   will remove everything if asked. Whenever it isn't obvious what
+   was meant, confirm is asked first and nothing happens unless it
+   says yes. by is who asked, for the audit log */
+func (self *Meta) RemoveFile(stash_node string, by string, confirm func(question string) bool) error {
+	if strings.HasPrefix(stash_node, delivery_prefix) {
+		return self.RemoveDelivery(stash_node, by, confirm)
+	}
 
-	node, file, exact := meta.Lookup(stash_node)
+	node, file, exact := self.Lookup(stash_node)
 	log.Debugln("\n\n*** \nFound: ", file, "\n", exact, "\n***\n\n")
-	if node != nil {
-		if file != nil {
-			if exact {
-				log.Println("Removing file: ", file.Name, " version: ", file.Version, " from stash: ", node.Id)
-				self.pullFromFiles(node, file)
-				return
-			} else {
-				log.Println("Didn't find exact file, should I remove version:", file.Version, " [yes/No]")
-				if Ask("no") {
-					self.pullFromFiles(node, file)
-				}
-				return
-			}
-			return
-		} else {
-			log.Println("Asked to remove entire stash... are you sure? [yes/No]")
-			if Ask("no") {
-				self.pullFromFiles(node, nil)
-				os.Remove(config.Stash_loc + "/" + node.Id)
-			}
-			return
+	if node == nil {
+		return errors.New("Unable to find file to remove")
+	}
+	if node.Hold != nil {
+		return fmt.Errorf("Stash %s is on hold, refusing to remove: %s", node.Id, node.Hold.Reason)
+	}
+	if file != nil {
+		if file.Held() {
+			return fmt.Errorf("File %s version %d is on hold, refusing to remove: %s", file.Name, file.Version, file.Hold.Reason)
 		}
+		if exact {
+			log.Println("Removing file: ", file.Name, " version: ", file.Version, " from stash: ", node.Id)
+			self.pullFromFiles(node, file, by)
+		} else if confirm(fmt.Sprintf("Didn't find exact file, should I remove version: %d [yes/No]", file.Version)) {
+			self.pullFromFiles(node, file, by)
+		}
+		return nil
 	}
-	log.Println("Unable to find file to remove")
-	return
+	if node.Held() {
+		return fmt.Errorf("Stash %s has files on hold, refusing to remove it", node.Id)
+	}
+	if confirm("Asked to remove entire stash... are you sure? [yes/No]") {
+		self.pullFromFiles(node, nil, by)
+	}
+	return nil
 }
 
 /* Used by Remove file, this rebuilds the splice and assigns
-   the new array of Files to self */
-func (self *Meta) pullFromFiles(node *Node, file *FilePointer) {
+   the new array of Files to self. A node that loses its last
+   pointer goes too. Whatever is removed lands in the trash, the
+   node's bytes included when the node goes */
+func (self *Meta) pullFromFiles(node *Node, file *FilePointer, by string) {
+	if err := self.lockMeta(); err != nil {
+		log.Warnln(err, "- the stash will be saved later")
+	} else {
+		defer self.unlockMeta()
+	}
 
 	whole_stash := false
 	if file == nil {
@@ -485,23 +628,41 @@ func (self *Meta) pullFromFiles(node *Node, file *FilePointer) {
 	}
 	var new_files []Node
 	for _, itr := range self.Files {
-		if itr.Compare(node) && whole_stash {
+		if itr.Compare(node) && itr.Held() && (whole_stash || itr.Hold != nil) {
+			log.Warnln("Stash", itr.Id, "is on hold, not removing")
+		} else if itr.Compare(node) && whole_stash {
 			log.Debugln("skipping whole stash: ", itr.Id)
-			continue
+			if self.toTrash(itr, itr.Pointers, true, by) == nil {
+				continue
+			}
 		} else if itr.Compare(node) && !whole_stash {
-			var new_pointers []FilePointer
+			var new_pointers, removed []FilePointer
+			had := itr.Pointers
 			for _, fitr := range itr.Pointers {
-				if fitr.Compare(file) {
+				if fitr.Compare(file) && fitr.Held() {
+					log.Warnln("File", fitr.Name, "version", fitr.Version, "is on hold, not removing")
+				} else if fitr.Compare(file) {
 					log.Debugln("skipping file from stash")
+					removed = append(removed, fitr)
 					continue
 				}
 				new_pointers = append(new_pointers, fitr)
 			}
 			itr.Pointers = new_pointers
+			if len(new_pointers) == 0 {
+				log.Infoln("Last pointer removed, freeing stash: ", itr.Id)
+				if self.toTrash(itr, removed, true, by) == nil {
+					continue
+				}
+				itr.Pointers = had //the bytes couldn't go, neither can the pointers
+			} else if len(removed) > 0 {
+				self.toTrash(itr, removed, false, by)
+			}
 		}
 		new_files = append(new_files, itr)
 	}
 	self.Files = new_files
+	self.Count = len(self.Files)
 	log.Debug("\n\n***\nFiles:\n\n", self.Files, "\n\n***\n\n")
 	self.SaveStash()
 }
@@ -509,16 +670,85 @@ func (self *Meta) pullFromFiles(node *Node, file *FilePointer) {
 /* Export a file from the stash somewhere... if the somewhere is a
    directory, we tack on file's name, if it's a file we export to
    the new file name */
-func (self *Meta) ExportFile(node Node, file FilePointer, loc string) {
+func (self *Meta) ExportFile(node Node, file FilePointer, loc string) error {
+	fl, err := openStashFile(node)
+	if err != nil {
+		return err
+	}
+	defer fl.Close()
+	return exportFrom(fl, file, loc)
+}
 
+func openStashFile(node Node) (*os.File, error) {
 	log.Debugln("Opening stash: ", node.Id)
-	fl, err := os.Open(config.Stash_loc + "/" + node.Id)
+	fl, err := os.Open(conf().Stash_loc + "/" + node.Id)
+	if err != nil {
+		return nil, errors.New("Invalid stash, failed to open: " + node.Id)
+	}
 	st, err := fl.Stat()
 	if err != nil || st.IsDir() {
-		log.Errorln("Invalid stash, failed to open:", node.Id)
-		return
+		fl.Close()
+		return nil, errors.New("Invalid stash, failed to open: " + node.Id)
 	}
-	defer fl.Close()
+	return fl, nil
+}
+
+/* An export waiting to be copied out. The stash file is opened while
+   we own the stash, the bytes stay put for us even if the stash is
+   extended or removed later, so the copy can run without holding up
+   the stash. */
+type pendingExport struct {
+	node Node
+	file FilePointer
+	dest string
+	fl   *os.File
+}
+
+/* Find what target, a file or delivery:<id>, exports to dest and open
+   the stash files for it. Runs on the stash go routine. */
+func (self *Meta) prepareExport(target string, dest string) (exports []pendingExport, err error) {
+	if strings.HasPrefix(target, delivery_prefix) {
+		exports, err = self.deliveryExports(target, dest)
+	} else if node, file, _ := self.Lookup(target); node == nil || file == nil {
+		err = errors.New("Unable to find " + target + " in the stash")
+	} else {
+		exports = []pendingExport{{node: *node, file: *file, dest: dest}}
+	}
+	for itr := 0; itr < len(exports) && err == nil; itr++ {
+		exports[itr].fl, err = openStashFile(exports[itr].node)
+	}
+	if err != nil {
+		closeExports(exports)
+		return nil, err
+	}
+	return
+}
+
+/* Copy prepared exports out, on behalf of by. Stops at the first
+   one that fails. */
+func runExports(exports []pendingExport, by string) (err error) {
+	defer closeExports(exports)
+	for _, ex := range exports {
+		err = exportFrom(ex.fl, ex.file, ex.dest)
+		audit.Export(by, ex.node, ex.file, ex.dest, err)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func closeExports(exports []pendingExport) {
+	for _, ex := range exports {
+		if ex.fl != nil {
+			ex.fl.Close()
+		}
+	}
+}
+
+/* Copy file out of the opened stash file fl to loc */
+func exportFrom(fl *os.File, file FilePointer, loc string) error {
+	fl.Seek(0, 0)
 
 	log.Debugln("Testing for directory?")
 	if st, err := os.Stat(loc); err == nil { //adjusts if loc is a dir
@@ -528,10 +758,9 @@ func (self *Meta) ExportFile(node Node, file FilePointer, loc string) {
 	}
 
 	log.Debugln("Opening output file: ", loc)
-	of, err := os.OpenFile(loc, os.O_CREATE|os.O_RDWR, 0666)
+	of, err := os.OpenFile(loc, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
 	if err != nil {
-		log.Errorln("Failed to open output location:", loc)
-		return
+		return errors.New("Failed to open output location: " + loc)
 	}
 	defer of.Close()
 
@@ -550,19 +779,20 @@ func (self *Meta) ExportFile(node Node, file FilePointer, loc string) {
 			log.Debugln("EOF at ", sz, " bytes")
 			break
 		}
-		if int64(sz) > file.Size {
-			sz = int(file.Size)
+		if int64(sz) > sp {
+			sz = int(sp)
 		}
 		wr, err := of.Write(buff[:sz])
 		//log.Debugln("Read ", sz, " bytes, Wrote ", wr, " bytes to output file")
 		if err != nil {
-			log.Errorln("Failure during file export from stash:", loc)
+			return errors.New("Failure during file export from stash: " + loc)
 		}
 		sp -= int64(wr)
 		wrote += wr
 		log.Debugln(sp, " bytes left to write")
 	}
 	log.Debugln("Wrote: ", wrote, " bytes total")
+	return nil
 }
 
 /* Ask the user if this is OK */
@@ -0,0 +1,91 @@
+package main
+
+/*-----------------------------------------------
+ metalock.go
+
+ Advisory locking of the meta file between the
+ daemon and the management commands
+-----------------------------------------------*/
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/* Take the meta lock, an exclusive flock on Config_loc/meta.lock.
+   Every read-modify-write of the meta file happens under it, so two
+   processes can't lose each other's updates. The lock nests, only
+   the outermost unlockMeta lets it go. When another process holds
+   it we wait up to Meta_lock_seconds before giving up. */
+func (self *Meta) lockMeta() error {
+	if self.lock_depth > 0 {
+		self.lock_depth++
+		return nil
+	}
+	fl, err := os.OpenFile(conf().Config_loc+"/meta.lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(conf().Meta_lock_seconds * time.Second)
+	warned := false
+	for {
+		err = syscall.Flock(int(fl.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			fl.Close()
+			return err
+		}
+		if time.Now().After(deadline) {
+			fl.Close()
+			return fmt.Errorf("The stash meta data is locked by another dropstash process%s, gave up after %v",
+				lockHolder(), conf().Meta_lock_seconds*time.Second)
+		}
+		if !warned {
+			log.Warnln("Waiting on the meta lock held by another dropstash process" + lockHolder())
+			warned = true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	//note who we are for anybody waiting on us
+	fl.Truncate(0)
+	fl.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	self.lock = fl
+	self.lock_depth = 1
+	return nil
+}
+
+/* Release the meta lock taken with lockMeta */
+func (self *Meta) unlockMeta() {
+	if self.lock_depth == 0 {
+		return
+	}
+	self.lock_depth--
+	if self.lock_depth > 0 {
+		return
+	}
+	self.lock.Truncate(0)
+	syscall.Flock(int(self.lock.Fd()), syscall.LOCK_UN)
+	self.lock.Close()
+	self.lock = nil
+}
+
+/* Describe who holds the meta lock, for the error messages */
+func lockHolder() string {
+	bts, err := ioutil.ReadFile(conf().Config_loc + "/meta.lock")
+	if err != nil {
+		return ""
+	}
+	pid := strings.TrimSpace(string(bts))
+	if pid == "" {
+		return ""
+	}
+	return " (pid " + pid + ")"
+}
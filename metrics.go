@@ -0,0 +1,165 @@
+package main
+
+/*-----------------------------------------------
+ metrics.go
+
+ Counters for the daemon, served in the
+ Prometheus text format on /metrics
+-----------------------------------------------*/
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/* Metrics keeps the counters the daemon exposes. The stash gauges
+   are kept up to date by the stash loop, so a scrape never waits on
+   it, the queue depth is read when scraped.
+   - pickups counts files handed to the stash, by location
+   - outcomes counts what append made of them
+   - saved_bytes is how many bytes de-duplication didn't store
+   - hashed_bytes and hash_seconds give the hashing throughput
+   - saves and save_seconds give the meta save latency
+   - logged counts warnings and errors logged, by level
+   - stash is the stash stats as of the last change */
+type Metrics struct {
+	mu           sync.Mutex
+	pickups      map[string]int64
+	outcomes     map[string]int64
+	saved_bytes  int64
+	hashed_bytes int64
+	hash_seconds float64
+	saves        int64
+	save_seconds float64
+	logged       map[string]int64
+	stash        Stats
+}
+
+func (self *Metrics) init() {
+	self.pickups = map[string]int64{}
+	self.outcomes = map[string]int64{"duplicate": 0, "partial": 0, "extended": 0, "unique": 0}
+	self.logged = map[string]int64{"warning": 0, "error": 0}
+}
+
+func (self *Metrics) Pickup(location string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.pickups[location]++
+}
+
+/* Record an append outcome and the bytes it saved us */
+func (self *Metrics) Outcome(outcome string, saved int64) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.outcomes[outcome]++
+	self.saved_bytes += saved
+}
+
+func (self *Metrics) Hashed(bytes int64, took time.Duration) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.hashed_bytes += bytes
+	self.hash_seconds += took.Seconds()
+}
+
+func (self *Metrics) Saved(took time.Duration) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.saves++
+	self.save_seconds += took.Seconds()
+}
+
+/* Keep the stash gauges, called by the stash loop on every change */
+func (self *Metrics) Stashed(stats Stats) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.stash = stats
+}
+
+/* Levels implements logrus.Hook, counting warnings and errors */
+func (self *Metrics) Levels() []log.Level {
+	return []log.Level{log.WarnLevel, log.ErrorLevel, log.FatalLevel, log.PanicLevel}
+}
+
+func (self *Metrics) Fire(entry *log.Entry) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.logged[entry.Level.String()]++
+	return nil
+}
+
+/* Escape a label value for the text format */
+func labelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+/* Write a metric family with one sample per label value */
+func writeFamily(w io.Writer, name, kind, help, label string, values map[string]int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, labelValue(k), values[k])
+	}
+}
+
+/* Write a single unlabelled sample */
+func writeSample(w io.Writer, name, kind, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
+
+/* Copy the counters, so a slow scrape never holds up the stash */
+func (self *Metrics) snapshot() (copy Metrics) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	copy.init()
+	for k, v := range self.pickups {
+		copy.pickups[k] = v
+	}
+	for k, v := range self.outcomes {
+		copy.outcomes[k] = v
+	}
+	for k, v := range self.logged {
+		copy.logged[k] = v
+	}
+	copy.saved_bytes = self.saved_bytes
+	copy.hashed_bytes = self.hashed_bytes
+	copy.hash_seconds = self.hash_seconds
+	copy.saves = self.saves
+	copy.save_seconds = self.save_seconds
+	copy.stash = self.stash
+	return
+}
+
+/* GET /metrics */
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	m := metrics.snapshot()
+	stats := m.stash
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeFamily(w, "dropstash_pickups_total", "counter", "Files handed to the stash, by location.", "location", m.pickups)
+	writeFamily(w, "dropstash_outcomes_total", "counter", "What de-duplication made of each pickup.", "outcome", m.outcomes)
+	writeSample(w, "dropstash_dedupe_saved_bytes_total", "counter", "Bytes de-duplication kept out of the stash.", m.saved_bytes)
+	writeSample(w, "dropstash_stash_physical_bytes", "gauge", "Bytes kept in the stash.", stats.Physical)
+	writeSample(w, "dropstash_stash_logical_bytes", "gauge", "Bytes of every version in the stash.", stats.Logical)
+	writeSample(w, "dropstash_stash_nodes", "gauge", "Stashes in the stash.", stats.Nodes)
+	writeSample(w, "dropstash_stash_pointers", "gauge", "File versions in the stash.", stats.Pointers)
+	hashing := pool.Status()
+	writeSample(w, "dropstash_queue_depth", "gauge", "Files waiting on the stash.", intake.Pending())
+	writeSample(w, "dropstash_hash_workers_busy", "gauge", "Hash workers hashing a file.", hashing.Busy)
+	writeSample(w, "dropstash_hash_waiting", "gauge", "Hashed files waiting on the stash.", hashing.Waiting)
+	writeSample(w, "dropstash_hashed_bytes_total", "counter", "Bytes run through the hash.", m.hashed_bytes)
+	writeSample(w, "dropstash_hash_seconds_total", "counter", "Time spent hashing.", m.hash_seconds)
+	fmt.Fprintf(w, "# HELP dropstash_save_seconds Time taken to save the meta data.\n# TYPE dropstash_save_seconds summary\n")
+	fmt.Fprintf(w, "dropstash_save_seconds_sum %v\ndropstash_save_seconds_count %d\n", m.save_seconds, m.saves)
+	writeFamily(w, "dropstash_log_messages_total", "counter", "Warnings and errors logged, by level.", "level", m.logged)
+}
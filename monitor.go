@@ -8,14 +8,122 @@ package main
 -----------------------------------------------*/
 import (
 	"errors"
+	"io/ioutil"
 	"os"
 	"path"
+	"sync"
+	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/fsnotify/fsnotify"
 	"github.com/google/uuid"
 )
 
+/* Every monitor is registered here, keyed by location, so the rest
+   of the daemon can start and stop them one location at a time, ask
+   them to sweep their location and see how they are doing. A
+   monitor that failed stays registered with its error.
+   - sweep is how a monitor is asked to sweep its location
+   - stop is closed to stop the monitor, it closes exited once it
+     has finished with whatever it was picking up
+   - err is why the monitor isn't watching, nil while it is */
+type monitorState struct {
+	sweep  chan bool
+	stop   chan bool
+	exited chan bool
+	err    error
+}
+
+var (
+	mon_mu   sync.Mutex
+	monitors = map[string]*monitorState{}
+)
+
+/* Ask every running monitor to sweep its location */
+func requestSweep() {
+	mon_mu.Lock()
+	defer mon_mu.Unlock()
+	for _, state := range monitors {
+		select {
+		case state.sweep <- true:
+		default: //already has a sweep pending
+		}
+	}
+}
+
+/* Start monitoring location, unless it already is. With sweep set
+   the location is swept for files dropped before the monitor was
+   up. */
+func startMonitor(location string, sweep bool) {
+	mon_mu.Lock()
+	defer mon_mu.Unlock()
+	if _, ok := monitors[location]; ok {
+		return
+	}
+	state := &monitorState{sweep: make(chan bool, 1), stop: make(chan bool), exited: make(chan bool)}
+	if sweep {
+		state.sweep <- true
+	}
+	monitors[location] = state
+	go monitor(location, state)
+}
+
+/* Stop monitoring location, the monitor finishes what it is picking
+   up on its own */
+func stopMonitor(location string) {
+	mon_mu.Lock()
+	defer mon_mu.Unlock()
+	if state, ok := monitors[location]; ok {
+		close(state.stop)
+		delete(monitors, location)
+	}
+}
+
+/* The locations with a monitor, and those whose monitor failed */
+func monitoredLocations() (running map[string]bool) {
+	mon_mu.Lock()
+	defer mon_mu.Unlock()
+	running = map[string]bool{}
+	for location, state := range monitors {
+		running[location] = state.err == nil
+	}
+	return
+}
+
+/* Stop every monitor and wait for them to finish what they are
+   picking up, or for the deadline */
+func stopMonitors(deadline time.Time) {
+	mon_mu.Lock()
+	var stopping []*monitorState
+	for _, state := range monitors {
+		close(state.stop)
+		stopping = append(stopping, state)
+	}
+	monitors = map[string]*monitorState{}
+	mon_mu.Unlock()
+	for _, state := range stopping {
+		select {
+		case <-state.exited:
+		case <-time.After(time.Until(deadline)):
+			log.Warnln("A monitor is still busy, not waiting on it")
+			return
+		}
+	}
+}
+
+/* Report on the monitor for a location, the error says why it isn't
+   watching. Locations without a monitor haven't been started. */
+func monitorHealth(location string) (running bool, err error) {
+	mon_mu.Lock()
+	defer mon_mu.Unlock()
+	state, ok := monitors[location]
+	if !ok {
+		return false, errors.New("not monitored")
+	}
+	return state.err == nil, state.err
+}
+
 /* Simple check for permissions, ensures user is in the
    correct group. */
 func checkPermissions(location string) (loc_info os.FileInfo, err error) {
@@ -42,56 +150,176 @@ func checkPermissions(location string) (loc_info os.FileInfo, err error) {
 }
 
 /* This is where we do the actual location monitoring. This
-   is started as a concurent go routine, and monitors loc_id
-   indefinatly.
-   - loc_id is the index to the config.Locations array to
-     monitor*/
-func monitor(loc_id int, cont chan bool) {
-	log.Println("Spinning up monitor on location ID:", loc_id)
+   is started as a concurent go routine by startMonitor, and
+   monitors location until stopMonitor is called for it.
+   - state is the monitor's entry in the registry */
+func monitor(location string, state *monitorState) {
+	log.Println("Spinning up monitor on location:", location)
 
 	stop := false
-	location := config.Locations[loc_id]
-	if st, err := checkPermissions(location); err != nil {
+	sweep_req := state.sweep
+	defer close(state.exited)
+	failed := func(err error) {
 		log.Error(err)
+		mon_mu.Lock()
+		state.err = err
+		mon_mu.Unlock()
+	}
+
+	if st, err := checkPermissions(location); err != nil {
+		failed(err)
 		return
 	} else {
 		log.Infoln("Permissions check for", location, "passed:", st.Mode())
 	}
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		log.Error(err)
+		failed(err)
 		return
 	}
 	defer watcher.Close()
 
 	err = watcher.Add(location)
 	if err != nil {
-		log.Error(err)
+		failed(err)
 		return
 	}
 	log.Infoln("Watcher up; monitoring:", location)
+
+	var resweep <-chan time.Time //set while the location is muted
 	for !stop {
-		cached_id := uuid.New().String() //cache a new uuid
 		select {
 		case ev := <-watcher.Events:
 			log.Debugln("monitored directory event:", ev)
-			if ev.Op&fsnotify.Write == fsnotify.Write {
-				log.Info("Found; ", path.Base(ev.Name), " Moving to staging")
-				os.Rename(ev.Name, config.Staging_loc+"/"+cached_id)
-				var op Operation
-				op.Code = ProcessFile
-				op.Id = cached_id
-				op.Name = path.Base(ev.Name)
-				op.Location = path.Dir(ev.Name)
-				op.Overwrite = false //TODO determine if this should be gleamed from the file name
-				meta.stash <- op
+			//markers are usually empty, they never see a write
+			if ev.Op&fsnotify.Write == fsnotify.Write || (ev.Op&fsnotify.Create == fsnotify.Create && isDeliveryMarker(ev.Name)) {
+				if wait := pickup(location, ev.Name); wait > 0 && resweep == nil {
+					resweep = time.After(wait)
+				}
+			}
+		case <-resweep:
+			resweep = nil
+			if wait := sweep(location); wait > 0 {
+				resweep = time.After(wait)
+			}
+		case <-sweep_req:
+			if resweep == nil {
+				if wait := sweep(location); wait > 0 {
+					resweep = time.After(wait)
+				}
 			}
 		case err := <-watcher.Errors:
 			log.Error("Monitor error;", err)
 			continue
-		case stop = <-cont:
+		case <-state.stop:
 			log.Infoln("Spinning down monitor on ", location)
-			break
+			stop = true
 		}
 	}
 }
+
+/* Move a single dropped file into staging and queue it for the
+   stash. If the location is over its rate limit the file is left
+   where it is, and the time to wait before sweeping the location
+   again is returned. The same goes for a stash disk that is below
+   its critical mark, or paused intake, except the sweep is
+   requested once space frees up or intake resumes. */
+func pickup(location string, name string) (wait time.Duration) {
+	st, err := os.Stat(name)
+	if err != nil || !st.Mode().IsRegular() || isReceipt(name) {
+		return
+	}
+	if intake.Paused(path.Dir(name)) {
+		log.Debugln("Intake paused, leaving", path.Base(name), "in place")
+		return
+	}
+	if !disk.Check() {
+		log.Debugln("Stash disk is critical, leaving", path.Base(name), "in place")
+		return
+	}
+	marker := isDeliveryMarker(name)
+	if marker {
+		if held := markerWait(name, st); held > 0 {
+			return held
+		}
+	} else if held := sidecarWait(location, name, st); held > 0 {
+		log.Debugln("Leaving", path.Base(name), "in place for its sidecar pair")
+		return held
+	} else if _, err := os.Stat(name); err != nil {
+		return //went along with the file it is the sidecar of
+	}
+	if ok, wait := limiter.Allow(location, st.Size()); !ok {
+		log.Debugln("Location muted, leaving", path.Base(name), "in place")
+		return wait
+	}
+	var op Operation
+	op.Code = ProcessFile
+	op.Id = uuid.New().String()
+	op.Name = path.Base(name)
+	op.Location = path.Dir(name)
+	op.Overwrite = false //TODO determine if this should be gleamed from the file name
+	op.declared = findDeclared(name)
+	op.delivery = deliveries.For(op.Location)
+	op.picked = time.Now()
+	if err := journal.Add(op); err != nil { //the name is only in the journal once renamed
+		log.Errorln("Failed to journal", name, ", leaving it in place:", err)
+		return
+	}
+	log.WithFields(log.Fields{"event": "pickup", "id": op.Id, "name": op.Name, "location": op.Location,
+		"size": st.Size()}).Info("Found; ", path.Base(name), " Moving to staging")
+	staged := conf().Staging_loc + "/" + op.Id
+	err = os.Rename(name, staged)
+	if lerr, ok := err.(*os.LinkError); ok && lerr.Err == syscall.EXDEV {
+		var digest Digest
+		if digest, err = copyToStaging(name, staged, op.declared.wantsSha256()); err == nil {
+			op.digest = &digest
+			if jerr := journal.Add(op); jerr != nil { //keep the digest with the record
+				log.Warnln("Failed to journal the digest of", name, ":", jerr)
+			}
+		}
+	}
+	if err != nil {
+		log.Errorln("Failed to move", name, "to staging:", err)
+		journal.Done(op.Id)
+		return
+	}
+	if marker { //staged, it's the last file of its delivery
+		closeDelivery(op.Location)
+	}
+	intake.Submit(op)
+	return pickupSidecars(location, name)
+}
+
+/* Pick up everything that was left behind in a location, this
+   happens once a muted location has cooled down. Stops early if
+   the location gets muted or paused again. Files held for their
+   sidecar pair are passed over, the shortest wait among them is
+   returned. */
+func sweep(location string) (wait time.Duration) {
+	entries, err := ioutil.ReadDir(location)
+	if err != nil {
+		log.Errorln("Failed to sweep", location, ":", err)
+		return
+	}
+	if intake.Paused(location) {
+		return
+	}
+	log.Infoln("Sweeping", location, "for files left behind")
+	for _, ent := range entries {
+		if !ent.Mode().IsRegular() {
+			continue
+		}
+		if held := pickup(location, location+"/"+ent.Name()); held > 0 {
+			if wait == 0 || held < wait {
+				wait = held
+			}
+			if limiter.Muted(location) {
+				return
+			}
+		}
+		if disk.Critical() || intake.Paused(location) {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,306 @@
+package main
+
+/*-----------------------------------------------
+ receipt.go
+
+ Signed delivery receipts, proof for a client
+ that its file made it into the stash intact
+-----------------------------------------------*/
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/* Receipt is what a client gets back for a file, written out as
+   <name>.receipt next to where it was dropped.
+   - ChkSum is the MD5 of the file as it was picked up
+   - Node and Version say where it is in the stash
+   - Verify is what came of checking it against its sidecar
+   - Delivery is the batch it came in with
+   - Key is the public key it was signed with, base64, so a client
+     with more than one daemon's key can tell which to check it with
+   - Signature is the ed25519 signature of the receipt written out
+     with Signature empty, base64 */
+type Receipt struct {
+	Name      string
+	Size      int64
+	ChkSum    string
+	Node      string
+	Version   int
+	Location  string
+	Verify    string `json:",omitempty"`
+	Delivery  string `json:",omitempty"`
+	Date      time.Time
+	Key       string
+	Signature string
+}
+
+const receipt_suffix = ".receipt"
+
+/* A receipt is a few hundred bytes, anything much bigger isn't one */
+const max_receipt_bytes = 64 * 1024
+
+/* The receipt key, loaded on first use. Kept along with the path it
+   came from, a reload may point Receipt_key elsewhere. Receipts part
+   way through being written are in receipts_writing. */
+var (
+	receipt_mu   sync.Mutex
+	receipt_key  ed25519.PrivateKey
+	receipt_from string
+
+	receipts_writing = map[string]bool{}
+)
+
+/* Where the public half of the receipt key is kept, for handing to
+   clients */
+func receiptPublicKey() string {
+	return conf().Receipt_key + ".pub"
+}
+
+/* Load the receipt key, making one the first time around, along with
+   its public half */
+func receiptKey() (ed25519.PrivateKey, error) {
+	receipt_mu.Lock()
+	defer receipt_mu.Unlock()
+	if receipt_key != nil && receipt_from == conf().Receipt_key {
+		return receipt_key, nil
+	}
+	if bts, err := ioutil.ReadFile(conf().Receipt_key); err == nil {
+		block, _ := pem.Decode(bts)
+		if block == nil {
+			return nil, errors.New("No key found in " + conf().Receipt_key)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New(conf().Receipt_key + " isn't an ed25519 key")
+		}
+		receipt_key, receipt_from = key, conf().Receipt_key
+		return key, nil
+	}
+
+	log.Warnln("No receipt key:", conf().Receipt_key, "creating")
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(conf().Receipt_key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	if der, err = x509.MarshalPKIXPublicKey(public); err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(receiptPublicKey(), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		return nil, err
+	}
+	receipt_key, receipt_from = key, conf().Receipt_key
+	return key, nil
+}
+
+/* Load a public key written out by receiptKey */
+func loadReceiptPublicKey(name string) (ed25519.PublicKey, error) {
+	bts, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(bts)
+	if block == nil {
+		return nil, errors.New("No key found in " + name)
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New(name + " isn't an ed25519 key")
+	}
+	return key, nil
+}
+
+/* What gets signed, the receipt with Signature empty */
+func (self Receipt) signed() ([]byte, error) {
+	self.Signature = ""
+	return json.Marshal(self)
+}
+
+/* Is the receipt signed by key */
+func (self Receipt) CheckSignature(key ed25519.PublicKey) error {
+	if self.Key != base64.StdEncoding.EncodeToString(key) {
+		return errors.New("signed with a different key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(self.Signature)
+	if err != nil {
+		return errors.New("unreadable signature")
+	}
+	msg, err := self.signed()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, msg, sig) {
+		return errors.New("bad signature, the receipt was altered")
+	}
+	return nil
+}
+
+/* Where receipts for a location go; its entry in Receipt_dirs, or
+   the location itself if it's a directory we watch. Uploads over
+   HTTP and SFTP only get receipts with a Receipt_dirs entry. */
+func receiptDir(location string) string {
+	if dir, ok := conf().Receipt_dirs[location]; ok {
+		return dir
+	}
+	for _, watched := range conf().Locations {
+		if filepath.Clean(watched) == location {
+			return location
+		}
+	}
+	return ""
+}
+
+/* Is name a receipt we wrote, the monitors leave those alone. Only
+   while receipts are turned on, in a directory receipts go to, and
+   signed with our key; anything else ending in .receipt is a client's
+   file like any other. One we are still writing counts too. */
+func isReceipt(name string) bool {
+	if !conf().Receipts || !strings.HasSuffix(name, receipt_suffix) {
+		return false
+	}
+	receipt_mu.Lock()
+	writing := receipts_writing[name]
+	receipt_mu.Unlock()
+	if writing {
+		return true
+	}
+
+	dir, ours := filepath.Dir(name), false
+	for location := range conf().Receipt_dirs {
+		ours = ours || receiptDir(location) == dir
+	}
+	for _, location := range conf().Locations {
+		ours = ours || receiptDir(filepath.Clean(location)) == dir
+	}
+	if st, err := os.Stat(name); !ours || err != nil || st.Size() > max_receipt_bytes {
+		return false
+	}
+	var receipt Receipt
+	bts, err := ioutil.ReadFile(name)
+	if err != nil || json.Unmarshal(bts, &receipt) != nil {
+		return false
+	}
+	key, err := receiptKey()
+	if err != nil {
+		return false
+	}
+	return receipt.CheckSignature(key.Public().(ed25519.PublicKey)) == nil
+}
+
+/* Write a signed receipt for a file the stash now has, if receipts
+   are turned on. A later file of the same name replaces it. */
+func writeReceipt(node string, pointer FilePointer, chksum string) {
+	if !conf().Receipts {
+		return
+	}
+	dir := receiptDir(pointer.Location)
+	if dir == "" {
+		log.Debugln("No receipt directory for", pointer.Location, ", no receipt for", pointer.Name)
+		return
+	}
+	key, err := receiptKey()
+	if err != nil {
+		log.Errorln("Unable to load the receipt key, no receipt for", pointer.Name, ":", err)
+		return
+	}
+	receipt := Receipt{pointer.Name, pointer.Size, chksum, node, pointer.Version, pointer.Location,
+		pointer.Verify, pointer.Delivery, time.Now().UTC(), base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)), ""}
+	msg, err := receipt.signed()
+	if err != nil {
+		log.Errorln("Unable to sign a receipt for", pointer.Name, ":", err)
+		return
+	}
+	receipt.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, msg))
+	bts, err := json.MarshalIndent(receipt, "", "    ")
+	if err != nil {
+		log.Errorln("Unable to write a receipt for", pointer.Name, ":", err)
+		return
+	}
+	name := dir + "/" + filepath.Base(pointer.Name) + receipt_suffix
+	receipt_mu.Lock()
+	receipts_writing[name] = true
+	receipt_mu.Unlock()
+	err = ioutil.WriteFile(name, append(bts, '\n'), 0640)
+	receipt_mu.Lock()
+	delete(receipts_writing, name)
+	receipt_mu.Unlock()
+	if err != nil {
+		log.Errorln("Unable to write a receipt for", pointer.Name, ":", err)
+		return
+	}
+	log.Debugln("Wrote receipt", name)
+}
+
+/* The receipt command, only verify for now:
+   receipt verify [--key <public key>] <receipt>...
+   Works offline, all it needs is the public key, Receipt_key.pub
+   unless another is given. */
+func runReceipt(args []string) error {
+	if len(args) < 1 || args[0] != "verify" {
+		return errors.New("Receipt requires verify")
+	}
+	args = args[1:]
+	pub := receiptPublicKey()
+	if len(args) > 1 && (args[0] == "--key" || args[0] == "-key") {
+		pub, args = args[1], args[2:]
+	}
+	if len(args) == 0 {
+		return errors.New("Verify requires one or more receipts")
+	}
+	key, err := loadReceiptPublicKey(pub)
+	if err != nil {
+		return errors.New("Unable to load the receipt public key: " + err.Error())
+	}
+
+	failed := 0
+	for _, name := range args {
+		var receipt Receipt
+		bts, err := ioutil.ReadFile(name)
+		if err == nil {
+			err = json.Unmarshal(bts, &receipt)
+		}
+		if err == nil {
+			err = receipt.CheckSignature(key)
+		}
+		if err != nil {
+			fmt.Printf("%s: FAILED, %v\n", name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: OK, %s (%d bytes, md5 %s) stashed as %s:%d on %s\n", name, receipt.Name, receipt.Size,
+			receipt.ChkSum, receipt.Node, receipt.Version, receipt.Date.Format(time.RFC3339))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d receipts failed to verify", failed, len(args))
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+/*-----------------------------------------------
+ reload.go
+
+ Applies a changed config to the running daemon
+-----------------------------------------------*/
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsnotify/fsnotify"
+	"github.com/sevlyar/go-daemon"
+)
+
+/* Reloads come from SIGHUP and from the config watcher, one at a
+   time */
+var reload_mu sync.Mutex
+
+/* Wait this long after the last change to the config before
+   reloading, editors write a file in more than one go */
+const reload_settle = time.Second
+
+/* Reload the config and apply what changed. Only the monitors of
+   locations that were added or removed are started or stopped, the
+   others keep watching throughout. A location whose monitor failed
+   is given another go. The save interval, housekeeping interval,
+   rate limits, retention rules, HTTP token, SFTP clients and log
+   settings take effect right away. Settings the daemon only reads on
+   start are reported. A config that doesn't load, is missing, or
+   has no locations left when the running one had some is rejected
+   and the running config is kept. Either way it goes in the audit log
+   with who asked for it. */
+func reload(by string) error {
+	reload_mu.Lock()
+	defer reload_mu.Unlock()
+	old := conf()
+	var next Config
+	err := next.ParseConfig(false)
+	if err == nil && len(next.Locations) == 0 && len(old.Locations) > 0 {
+		err = errors.New("The new config has no locations, restart the daemon to stop watching all of them")
+	}
+	if err != nil {
+		log.Errorln("Rejected the new config, keeping the running one:", err)
+		audit.Reload(by, err)
+		return err
+	}
+	setConfig(&next)
+	audit.Reload(by, nil)
+
+	applyLogging()
+	if old.Log_loc != next.Log_loc && daemon.WasReborn() {
+		if err := logfile.Reopen(); err != nil {
+			log.Errorln("Unable to move the log to", next.Log_loc, ":", err)
+		}
+	}
+
+	for _, setting := range []struct {
+		name    string
+		was, is interface{}
+	}{
+		{"Stash_loc", old.Stash_loc, next.Stash_loc},
+		{"Staging_loc", old.Staging_loc, next.Staging_loc},
+		{"Control_socket", old.Control_socket, next.Control_socket},
+		{"Http_listen", old.Http_listen, next.Http_listen},
+		{"Sftp_listen", old.Sftp_listen, next.Sftp_listen},
+		{"Sftp_host_key", old.Sftp_host_key, next.Sftp_host_key},
+		{"Hash_workers", old.Hash_workers, next.Hash_workers},
+	} {
+		if !reflect.DeepEqual(setting.was, setting.is) {
+			log.Warnln(setting.name, "changed, restart the daemon for it to take effect")
+		}
+	}
+
+	wanted := map[string]bool{}
+	for _, location := range next.Locations {
+		wanted[location] = true
+	}
+	running := monitoredLocations()
+	for location := range running {
+		if !wanted[location] {
+			log.Infoln("Location", location, "removed from the config")
+			stopMonitor(location)
+		}
+	}
+	for _, location := range next.Locations {
+		healthy, ok := running[location]
+		switch {
+		case !ok:
+			log.Infoln("Location", location, "added to the config")
+			startMonitor(location, true)
+		case !healthy:
+			log.Infoln("Retrying location", location)
+			stopMonitor(location)
+			startMonitor(location, true)
+		}
+	}
+	return nil
+}
+
+/* Is name the config file or one of its drop-ins */
+func isConfigFile(name string) bool {
+	name = filepath.Clean(name)
+	return name == filepath.Clean(conf().Config_loc+"/config") ||
+		(filepath.Dir(name) == config_dropins && strings.HasSuffix(name, ".json"))
+}
+
+/* Watch the config file and its drop-ins and reload when they
+   change, runs as its own go routine in the daemon. The directories
+   are watched rather than the files, editors tend to replace a file
+   instead of writing to it. */
+func watchConfig() {
+	if !conf().Watch_config {
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Errorln("Unable to watch the config:", err)
+		return
+	}
+	defer watcher.Close()
+	if err = watcher.Add(conf().Config_loc); err != nil {
+		log.Errorln("Unable to watch the config:", err)
+		return
+	}
+	watcher.Add(config_dropins) //fine if there are none
+
+	var settle <-chan time.Time
+	for {
+		select {
+		case ev := <-watcher.Events:
+			if isConfigFile(ev.Name) && ev.Op&fsnotify.Chmod == 0 {
+				log.Debugln("Config change:", ev)
+				settle = time.After(reload_settle)
+			}
+		case <-settle:
+			settle = nil
+			log.Infoln("Config changed, reloading")
+			if reload("config watcher") == nil {
+				log.Println("configuration reloaded")
+			}
+		case err := <-watcher.Errors:
+			log.Errorln("Config watcher error:", err)
+		case <-stopping:
+			return
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+/*-----------------------------------------------
+ retention.go
+
+ Declarative retention rules and the automatic
+ expiry of old versions in the stash
+-----------------------------------------------*/
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/* RetentionRule describes how long files picked up from a location
+   are kept around:
+   - Location is the drop location the rule applies to, an empty
+     location applies to every location without a rule of its own
+   - Keep_versions keeps only the last N versions of a file name
+   - Max_age_days drops versions older than this many days
+   - Keep_min always keeps at least this many versions of a file
+     name no matter what, it is never less than one
+   A zero value turns the matching check off. Anything on hold is
+   left out altogether. */
+type RetentionRule struct {
+	Location      string
+	Keep_versions int
+	Max_age_days  int
+	Keep_min      int
+}
+
+/* A single file pointer the retention rules want gone */
+type Prune struct {
+	Node    Node
+	Pointer FilePointer
+	Reason  string
+}
+
+/* Find the rule for a location, a rule naming the location wins
+   over the catch all rule */
+func ruleFor(location string) (rule RetentionRule, ok bool) {
+	for _, r := range conf().Retention {
+		if r.Location == location {
+			return r, true
+		}
+		if r.Location == "" {
+			rule, ok = r, true
+		}
+	}
+	return
+}
+
+/* Work out what the retention rules would prune from the stash
+   right now. Versions are grouped by location and file name, the
+   newest first, then checked against the rule for the location. */
+func (self *Meta) RetentionPlan(now time.Time) (plan []Prune) {
+	type version struct {
+		node    *Node
+		pointer FilePointer
+	}
+	groups := map[string][]version{}
+	for itr := range self.Files {
+		node := &self.Files[itr]
+		for _, fp := range node.Pointers {
+			if node.Hold != nil || fp.Held() { //held versions never expire
+				continue
+			}
+			key := fp.Location + "/" + fp.Name
+			groups[key] = append(groups[key], version{node, fp})
+		}
+	}
+	for _, versions := range groups {
+		rule, ok := ruleFor(versions[0].pointer.Location)
+		if !ok {
+			continue
+		}
+		keep_min := rule.Keep_min
+		if keep_min < 1 {
+			keep_min = 1
+		}
+		sort.Slice(versions, func(i, j int) bool {
+			return versions[i].pointer.VersionDate.After(versions[j].pointer.VersionDate)
+		})
+		for itr, v := range versions {
+			reason := ""
+			switch {
+			case itr < keep_min:
+				continue
+			case rule.Keep_versions > 0 && itr >= rule.Keep_versions:
+				reason = fmt.Sprintf("more than %d versions", rule.Keep_versions)
+			case rule.Max_age_days > 0 && now.Sub(v.pointer.VersionDate) > time.Duration(rule.Max_age_days)*24*time.Hour:
+				reason = fmt.Sprintf("older than %d days", rule.Max_age_days)
+			default:
+				continue
+			}
+			plan = append(plan, Prune{*v.node, v.pointer, reason})
+		}
+	}
+	sort.Slice(plan, func(i, j int) bool {
+		return plan[i].Pointer.VersionDate.Before(plan[j].Pointer.VersionDate)
+	})
+	return
+}
+
+/* Apply the retention rules, pruning through the same path as a
+   manual remove, on behalf of by. Returns what was pruned. */
+func (self *Meta) ApplyRetention(by string) (plan []Prune) {
+	plan = self.RetentionPlan(time.Now())
+	for itr := range plan {
+		prune := &plan[itr]
+		log.Infoln("Retention pruning", prune.Node.Id+"/"+prune.Pointer.Name+":"+fmt.Sprint(prune.Pointer.Version),
+			"from", prune.Pointer.Location, "-", prune.Reason)
+		self.pullFromFiles(&prune.Node, &prune.Pointer, by)
+	}
+	if len(plan) > 0 {
+		self.RebuildLookup()
+	}
+	return
+}
+
+/* Print a retention plan for the retention command */
+func printPlan(plan []Prune, dry_run bool) {
+	const layout = "Jan 02 06 15:04:23"
+	verb, summary := "Pruned", "pruned"
+	if dry_run {
+		verb, summary = "Would prune", "would be pruned"
+	}
+	for _, prune := range plan {
+		fmt.Printf("%-12s %-36s %-30s %3d %-40s %v  %s\n", verb, prune.Node.Id, prune.Pointer.Name,
+			prune.Pointer.Version, prune.Pointer.Location, prune.Pointer.VersionDate.Format(layout), prune.Reason)
+	}
+	fmt.Printf("%d version(s) %s\n", len(plan), summary)
+}
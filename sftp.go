@@ -0,0 +1,263 @@
+package main
+
+/*-----------------------------------------------
+ sftp.go
+
+ Optional embedded SFTP drop server, uploads go
+ straight into staging and never sit in a shared
+ directory
+-----------------------------------------------*/
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/google/uuid"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+/* SftpClient maps the keys of a client to its tenant. Files a
+   client uploads are recorded under the location sftp:<Tenant>,
+   which is what rate limits and retention rules are keyed on.
+   - Authorized_keys are in the usual authorized_keys format */
+type SftpClient struct {
+	Tenant          string
+	Authorized_keys []string
+}
+
+/* Find the tenant a public key belongs to */
+func tenantFor(key ssh.PublicKey) (string, bool) {
+	for _, client := range conf().Sftp_clients {
+		for _, line := range client.Authorized_keys {
+			allowed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err != nil {
+				log.Warnln("Invalid authorized key for SFTP tenant", client.Tenant, ":", err)
+				continue
+			}
+			if bytes.Equal(allowed.Marshal(), key.Marshal()) {
+				return client.Tenant, true
+			}
+		}
+	}
+	return "", false
+}
+
+/* Load the SFTP host key, making one the first time around */
+func sftpHostKey() (ssh.Signer, error) {
+	if bts, err := ioutil.ReadFile(conf().Sftp_host_key); err == nil {
+		return ssh.ParsePrivateKey(bts)
+	}
+	log.Warnln("No SFTP host key:", conf().Sftp_host_key, "creating")
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(key, "dropstash")
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(conf().Sftp_host_key, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+/* sftpDrop is the file system a client sees: an empty directory it
+   can only write new files into */
+type sftpDrop struct {
+	tenant string
+}
+
+/* A file being uploaded, it goes to the stash once the client
+   closes it */
+type sftpUpload struct {
+	*os.File
+	name     string
+	location string
+}
+
+func (self *sftpUpload) Close() error {
+	err := self.File.Close()
+	var op Operation
+	op.Code = ProcessFile
+	op.Id = path.Base(self.File.Name())
+	op.Name = self.name
+	op.Location = self.location
+	op.delivery = deliveries.For(op.Location)
+	op.picked = time.Now()
+	fields := log.Fields{"event": "pickup", "id": op.Id, "name": op.Name, "location": op.Location}
+	if st, serr := os.Stat(self.File.Name()); serr == nil {
+		fields["size"] = st.Size()
+		limiter.Charge(op.Location, st.Size()) //Filewrite couldn't know how big it would be
+	}
+	log.WithFields(fields).Info("SFTP upload of ", self.name, " from ", self.location, " complete, handing it to the stash")
+	if jerr := journal.Add(op); jerr != nil { //again, with its delivery
+		log.Warnln("Failed to journal the delivery of SFTP upload", op.Id, ":", jerr)
+	}
+	intake.Submit(op)
+	return err
+}
+
+func (self *sftpDrop) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	location := "sftp:" + self.tenant
+	if !disk.Check() {
+		return nil, errors.New("The stash is out of space")
+	}
+	if ok, _ := limiter.Allow(location, 0); !ok {
+		return nil, errors.New("Too many uploads, try again later")
+	}
+	name := path.Base(r.Filepath)
+	//journaled before the first byte lands in staging, a crash part way
+	//through must not leave a file there nobody knows the name of
+	op := Operation{Code: ProcessFile, Id: uuid.New().String(), Name: name, Location: location, picked: time.Now()}
+	if err := journal.Add(op); err != nil {
+		log.Errorln("Failed to journal SFTP upload of", name, ":", err)
+		return nil, sftp.ErrSSHFxFailure
+	}
+	fl, err := os.OpenFile(conf().Staging_loc+"/"+op.Id, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Errorln("Failed to stage SFTP upload:", err)
+		journal.Done(op.Id)
+		return nil, sftp.ErrSSHFxFailure
+	}
+	log.Infoln("SFTP upload of", name, "from", location, "started")
+	return &sftpUpload{fl, name, location}, nil
+}
+
+func (self *sftpDrop) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	return nil, sftp.ErrSSHFxPermissionDenied
+}
+
+/* Setting times and modes is harmless, clients do it after an
+   upload, everything else is refused. Renames included, a closed
+   upload has already gone to the stash under its name */
+func (self *sftpDrop) Filecmd(r *sftp.Request) error {
+	if r.Method == "Setstat" {
+		return nil
+	}
+	return sftp.ErrSSHFxPermissionDenied
+}
+
+/* The drop always looks like an empty, writable directory */
+type dropDir struct{}
+
+func (dropDir) Name() string       { return "/" }
+func (dropDir) Size() int64        { return 0 }
+func (dropDir) Mode() os.FileMode  { return os.ModeDir | 0300 }
+func (dropDir) ModTime() time.Time { return time.Now() }
+func (dropDir) IsDir() bool        { return true }
+func (dropDir) Sys() interface{}   { return nil }
+
+type dropList []os.FileInfo
+
+func (self dropList) ListAt(out []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(self)) {
+		return 0, io.EOF
+	}
+	n := copy(out, self[offset:])
+	return n, nil
+}
+
+func (self *sftpDrop) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		return dropList{}, nil
+	case "Stat":
+		if path.Clean(r.Filepath) == "/" {
+			return dropList{dropDir{}}, nil
+		}
+		return nil, os.ErrNotExist
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+/* Handle one SSH connection, only the sftp subsystem is offered */
+func serveSftpConn(conn net.Conn, ssh_config *ssh.ServerConfig) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, ssh_config)
+	if err != nil {
+		log.Debugln("SFTP handshake with", conn.RemoteAddr(), "failed:", err)
+		return
+	}
+	defer sconn.Close()
+	tenant := sconn.Permissions.Extensions["tenant"]
+	log.Infoln("SFTP client", tenant, "connected from", sconn.RemoteAddr())
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := nc.Accept()
+		if err != nil {
+			log.Errorln("SFTP channel error:", err)
+			continue
+		}
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				//the payload is the subsystem name, length prefixed
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+			}
+		}(requests)
+
+		drop := &sftpDrop{tenant}
+		server := sftp.NewRequestServer(channel, sftp.Handlers{FileGet: drop, FilePut: drop, FileCmd: drop, FileList: drop})
+		if err := server.Serve(); err != nil && err != io.EOF {
+			log.Errorln("SFTP session for", tenant, "ended:", err)
+		}
+		server.Close()
+	}
+	log.Infoln("SFTP client", tenant, "disconnected")
+}
+
+/* Start the SFTP drop server if one is configured, runs as its own
+   go routine in the daemon */
+func serveSftp() {
+	if conf().Sftp_listen == "" {
+		return
+	}
+	signer, err := sftpHostKey()
+	if err != nil {
+		log.Errorln("Unable to load the SFTP host key:", err)
+		return
+	}
+	ssh_config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if tenant, ok := tenantFor(key); ok {
+				return &ssh.Permissions{Extensions: map[string]string{"tenant": tenant}}, nil
+			}
+			log.Warnln("SFTP login refused for", conn.User(), "from", conn.RemoteAddr())
+			return nil, errors.New("unknown key")
+		},
+	}
+	ssh_config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", conf().Sftp_listen)
+	if err != nil {
+		log.Errorln("Unable to start the SFTP server:", err)
+		return
+	}
+	onShutdown(func(time.Time) { ln.Close() })
+	log.Infoln("SFTP server up:", conf().Sftp_listen)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !shuttingDown() {
+				log.Errorln("SFTP server stopped:", err)
+			}
+			return
+		}
+		go serveSftpConn(conn, ssh_config)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+/*-----------------------------------------------
+ shutdown.go
+
+ Orderly shutdown of the daemon
+-----------------------------------------------*/
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/* stopping is closed as soon as a shutdown starts, quitting once the
+   daemon stops handing files to the stash. The servers register how
+   to stop taking new work with onShutdown. */
+var (
+	stopping    = make(chan bool)
+	quitting    = make(chan bool)
+	shutdown_mu sync.Mutex
+	closers     []func(deadline time.Time)
+)
+
+func onShutdown(fn func(deadline time.Time)) {
+	shutdown_mu.Lock()
+	defer shutdown_mu.Unlock()
+	closers = append(closers, fn)
+}
+
+func shuttingDown() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+/* Shut the daemon down within Shutdown_timeout_seconds:
+   - stop the monitors and servers so no new files come in
+   - let the files already picked up make it into the stash
+   - stop the stash, which saves the meta data
+   Whatever doesn't make it in time is still in staging and in the
+   journal, so it is picked up again on the next start. It is listed
+   in the log. A stash still busy at the deadline is left behind. */
+func shutdown() {
+	deadline := time.Now().Add(conf().Shutdown_timeout_seconds * time.Second)
+	log.Infoln("Shutting down, waiting up to", conf().Shutdown_timeout_seconds*time.Second, "for files in flight")
+	close(stopping)
+
+	stopMonitors(deadline)
+	shutdown_mu.Lock()
+	for _, fn := range closers {
+		fn(deadline)
+	}
+	shutdown_mu.Unlock()
+
+	for time.Now().Before(deadline) {
+		hashing := pool.Status()
+		if intake.Ready() == 0 && hashing.Busy == 0 && hashing.Waiting == 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	close(quitting)
+	<-intake.exited
+
+	hashing := pool.Status()
+	queued := intake.Queued()
+	if len(queued) > 0 || hashing.Busy > 0 || hashing.Waiting > 0 {
+		log.Warnln("Shutting down with", len(queued)+hashing.Busy+hashing.Waiting, "files not in the stash, they stay in staging for the next start")
+		for _, op := range queued {
+			log.Warnln("  Not stashed:", op.Name, "from", op.Location, "staged as", op.Id)
+		}
+		if hashing.Busy+hashing.Waiting > 0 {
+			log.Warnln("  Not stashed:", hashing.Busy+hashing.Waiting, "files being hashed")
+		}
+	}
+
+	//the stash may be deep in an append, it doesn't get to hold us past
+	//the deadline either, the journal has whatever it was working on
+	timeout := time.After(time.Until(deadline))
+	select {
+	case meta.stash <- Operation{Code: Stop}:
+	case <-timeout:
+		log.Warnln("The stash is still busy at the deadline, exiting without saving, the journal has what it was working on")
+		return
+	}
+	select {
+	case <-meta.stopped:
+		log.Infoln("Stash saved and closed")
+	case <-timeout:
+		log.Warnln("The stash didn't finish saving by the deadline, exiting")
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+/*-----------------------------------------------
+ sidecar.go
+
+ Checksums clients send along with their files,
+ file.iso.sha256 or a SHA256SUMS manifest, and
+ checking the files against them
+-----------------------------------------------*/
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+/* Declared is the checksum a client sent for a file
+   - Algo is md5 or sha256
+   - Sum is the checksum in hex, lower case
+   - Source is the sidecar or manifest it came from */
+type Declared struct {
+	Algo   string
+	Sum    string
+	Source string
+}
+
+/* What came of checking a file against its sidecar, recorded as
+   FilePointer.Verify */
+const (
+	Verified   = "verified"
+	Mismatch   = "mismatch"
+	Unverified = "unverified"
+)
+
+/* The sidecars we know, a per file sidecar is the file's name with
+   suffix on the end, a manifest lists any number of files */
+var sidecar_kinds = []struct {
+	suffix   string
+	manifest string
+	algo     string
+	length   int
+}{
+	{".sha256", "SHA256SUMS", "sha256", 64},
+	{".md5", "MD5SUMS", "md5", 32},
+}
+
+/* Don't read more than this of a sidecar or manifest */
+const max_sidecar_bytes = 1024 * 1024
+
+/* How often a manifest checks on the files it's waiting for */
+const manifest_poll = 5 * time.Second
+
+/* Is name a sidecar or a manifest */
+func isSidecar(name string) bool {
+	base := path.Base(name)
+	for _, kind := range sidecar_kinds {
+		if base == kind.manifest || (strings.HasSuffix(base, kind.suffix) && base != kind.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isManifest(name string) bool {
+	for _, kind := range sidecar_kinds {
+		if path.Base(name) == kind.manifest {
+			return true
+		}
+	}
+	return false
+}
+
+/* Read the checksums in a sidecar or manifest, by file name. Both
+   the coreutils lines, '<sum>  <name>' or '<sum> *<name>', and the
+   BSD ones, 'SHA256 (<name>) = <sum>', are understood. A sidecar
+   holding nothing but the sum has it under the name "". */
+func readSums(name string, length int) map[string]string {
+	sums := map[string]string{}
+	fl, err := os.Open(name)
+	if err != nil {
+		return sums
+	}
+	defer fl.Close()
+	scanner := bufio.NewScanner(io.LimitReader(fl, max_sidecar_bytes))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var sum, file string
+		if open := strings.Index(line, " ("); open > 0 && strings.Contains(line, ") = ") {
+			close := strings.LastIndex(line, ") = ")
+			file, sum = line[open+2:close], line[close+4:]
+		} else if fields := strings.SplitN(line, " ", 2); len(fields) > 0 {
+			sum = fields[0]
+			if len(fields) == 2 {
+				file = strings.TrimPrefix(strings.TrimSpace(fields[1]), "*")
+			}
+		}
+		sum = strings.ToLower(sum)
+		if _, err := hex.DecodeString(sum); err != nil || len(sum) != length {
+			continue
+		}
+		if file != "" {
+			file = path.Base(file)
+		}
+		sums[file] = sum
+	}
+	return sums
+}
+
+/* The files a sidecar or manifest covers */
+func sidecarCovers(name string) (covers []string) {
+	base := path.Base(name)
+	for _, kind := range sidecar_kinds {
+		if base == kind.manifest {
+			for file := range readSums(name, kind.length) {
+				if file != "" {
+					covers = append(covers, path.Dir(name)+"/"+file)
+				}
+			}
+			return
+		}
+		if strings.HasSuffix(base, kind.suffix) {
+			return []string{strings.TrimSuffix(name, kind.suffix)}
+		}
+	}
+	return
+}
+
+/* Find what a client declared for a dropped file; its own sidecar
+   first, then a manifest in the same directory. nil when there is
+   neither. */
+func findDeclared(name string) *Declared {
+	base := path.Base(name)
+	for _, kind := range sidecar_kinds {
+		sums := readSums(name+kind.suffix, kind.length)
+		sum, ok := sums[base]
+		if !ok {
+			sum, ok = sums[""]
+		}
+		if ok {
+			return &Declared{kind.algo, sum, name + kind.suffix}
+		}
+	}
+	for _, kind := range sidecar_kinds {
+		manifest := path.Dir(name) + "/" + kind.manifest
+		if sum, ok := readSums(manifest, kind.length)[base]; ok {
+			return &Declared{kind.algo, sum, manifest}
+		}
+	}
+	return nil
+}
+
+/* Check a hashed file against what was declared for it */
+func (self *Declared) check(digest *Digest) string {
+	if self == nil {
+		return Unverified
+	}
+	actual := digest.ChkSum
+	if self.Algo == "sha256" {
+		actual = digest.Sha256
+	}
+	if actual == self.Sum {
+		return Verified
+	}
+	return Mismatch
+}
+
+/* Does checking a file against what was declared need its SHA-256 */
+func (self *Declared) wantsSha256() bool {
+	return self != nil && self.Algo == "sha256"
+}
+
+/* How long to leave a dropped file where it is for the sake of its
+   pair. A data file, with its sidecar or without one yet, and a
+   sidecar without its data file yet, wait until Sidecar_wait_seconds
+   after they last changed; a data file whose sidecar came first may
+   well still be on its way in. A sidecar whose data file is already
+   here hands it to pickup first, and a manifest waits on every file
+   it lists. */
+func sidecarWait(location string, name string, st os.FileInfo) time.Duration {
+	left := conf().Sidecar_wait_seconds*time.Second - time.Since(st.ModTime())
+	if !isSidecar(name) {
+		if left > 0 {
+			return left
+		}
+		return 0
+	}
+
+	waiting := false
+	for _, data := range sidecarCovers(name) {
+		if st, err := os.Stat(data); err != nil || !st.Mode().IsRegular() {
+			continue
+		}
+		if !isManifest(name) {
+			pickup(location, data)
+			if _, err := os.Stat(data); err != nil {
+				continue
+			}
+		}
+		waiting = true
+	}
+	switch {
+	case left > 0:
+		return left
+	case waiting:
+		return manifest_poll
+	}
+	return 0
+}
+
+/* Pick up the sidecars of a file that just went to staging, they
+   were waiting on it. Returns how long any of them still waits. */
+func pickupSidecars(location string, name string) (wait time.Duration) {
+	for _, kind := range sidecar_kinds {
+		if _, err := os.Stat(name + kind.suffix); err != nil {
+			continue
+		}
+		if held := pickup(location, name+kind.suffix); held > 0 && (wait == 0 || held < wait) {
+			wait = held
+		}
+	}
+	return
+}
@@ -0,0 +1,239 @@
+package main
+
+/*-----------------------------------------------
+ status.go
+
+ The status command, asks the running daemon how
+ it is doing
+-----------------------------------------------*/
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/* Exit codes of the status command, for scripts */
+const (
+	StatusRunning    = 0
+	StatusUnhealthy  = 1
+	StatusNotRunning = 3
+)
+
+/* Status is what the daemon reports about itself
+   - Healthy is false when a location isn't being watched or the
+     stash disk is critical
+   - Hashing reports on the hash pool, saturated means files are
+     backing up behind it
+   - Paused lists the locations intake is paused for, an empty one
+     means all of them
+   - LastSave is when the meta file was last written
+   - Errors are the most recent errors logged */
+type Status struct {
+	Running   bool
+	Healthy   bool
+	Pid       int
+	Started   time.Time
+	Uptime    int64
+	Locations []LocationStatus
+	Pending   int
+	Hashing   HashStatus
+	Paused    []string
+	LastSave  time.Time
+	Stash     Stats
+	Disk      string
+	Errors    []LoggedError
+}
+
+/* LocationStatus is the health of a single watched location */
+type LocationStatus struct {
+	Location string
+	Healthy  bool
+	State    string
+}
+
+type LoggedError struct {
+	Date    time.Time
+	Level   string
+	Message string
+}
+
+/* ErrorLog keeps the last few errors logged, it's a logrus.Hook */
+type ErrorLog struct {
+	mu      sync.Mutex
+	entries []LoggedError
+}
+
+const error_log_size = 10
+
+func (self *ErrorLog) Levels() []log.Level {
+	return []log.Level{log.ErrorLevel, log.FatalLevel, log.PanicLevel}
+}
+
+func (self *ErrorLog) Fire(entry *log.Entry) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.entries = append(self.entries, LoggedError{entry.Time, entry.Level.String(), strings.TrimSpace(entry.Message)})
+	if len(self.entries) > error_log_size {
+		self.entries = self.entries[len(self.entries)-error_log_size:]
+	}
+	return nil
+}
+
+func (self *ErrorLog) Recent() []LoggedError {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return append([]LoggedError(nil), self.entries...)
+}
+
+/* Put together the daemon's status */
+func daemonStatus() (status Status, err error) {
+	err = meta.do(func(stash localStash) error {
+		status.Stash = stash.meta.Stats()
+		if stash.meta.saved != nil {
+			status.LastSave = stash.meta.saved.ModTime()
+		}
+		return nil
+	})
+	status.Running = true
+	status.Healthy = true
+	status.Pid = os.Getpid()
+	status.Started = started
+	status.Uptime = int64(time.Since(started).Seconds())
+	status.Pending = intake.Pending()
+	status.Stash.Pending = status.Pending
+	status.Disk = disk.State()
+	status.Errors = error_log.Recent()
+	status.Paused = intake.PausedList()
+	status.Hashing = pool.Status()
+	if status.Disk == "critical" {
+		status.Healthy = false
+	}
+	for _, location := range conf().Locations {
+		ls := LocationStatus{Location: location, Healthy: true, State: "watching"}
+		if running, err := monitorHealth(location); !running {
+			ls.Healthy = false
+			ls.State = err.Error()
+			status.Healthy = false
+		} else if intake.Paused(location) {
+			ls.State = "paused"
+		}
+		status.Locations = append(status.Locations, ls)
+	}
+	return
+}
+
+/* Read the daemon's pid file and check the process is still there */
+func daemonPid() (pid int, alive bool) {
+	bts, err := ioutil.ReadFile(conf().Config_loc + "/pid")
+	if err != nil {
+		return
+	}
+	if pid, err = strconv.Atoi(strings.TrimSpace(string(bts))); err != nil || pid <= 0 {
+		return 0, false
+	}
+	err = syscall.Kill(pid, 0)
+	return pid, err == nil || err == syscall.EPERM
+}
+
+/* How long status waits on the daemon before calling it unhealthy */
+const status_timeout = 10 * time.Second
+
+/* Run the status command, returns the exit code. The pid file says
+   whether a daemon should be there, the control socket whether it is
+   actually answering. */
+func runStatus(args []string) int {
+	as_json := false
+	for _, arg := range args {
+		if arg == "--json" || arg == "-json" {
+			as_json = true
+		}
+	}
+
+	pid, alive := daemonPid()
+	var status Status
+	remote, err := dialControl()
+	if err == nil {
+		defer remote.Close()
+		//a daemon stuck on its stash must not leave us hanging too
+		remote.conn.SetDeadline(time.Now().Add(status_timeout))
+		err = remote.client.Call("Controller.Status", ControlArgs{}, &status)
+	}
+	code := StatusRunning
+	switch {
+	case err != nil && !alive:
+		code = StatusNotRunning
+	case err != nil:
+		status = Status{Running: true, Pid: pid}
+		status.Errors = []LoggedError{{time.Now(), "error", "Not answering on the control socket: " + err.Error()}}
+		code = StatusUnhealthy
+	case !status.Healthy:
+		code = StatusUnhealthy
+	}
+
+	if as_json {
+		bts, _ := json.MarshalIndent(status, "", "    ")
+		fmt.Println(string(bts))
+		return code
+	}
+	if !status.Running {
+		fmt.Printf("\nDropstash daemon not running, please start.\n\n")
+		return code
+	}
+	printStatus(status)
+	return code
+}
+
+func printStatus(status Status) {
+	const layout = "Jan 02 06 15:04:05"
+	health := "healthy"
+	if !status.Healthy {
+		health = "UNHEALTHY"
+	}
+	fmt.Printf("\nDropstash running (pid %d), %s\n", status.Pid, health)
+	if status.Started.IsZero() {
+		fmt.Println()
+		for _, e := range status.Errors {
+			fmt.Printf("  %s\n\n", e.Message)
+		}
+		return
+	}
+	fmt.Printf("  Started:    %v, up %v\n", status.Started.Format(layout), time.Duration(status.Uptime)*time.Second)
+	fmt.Printf("  Pending:    %d files\n", status.Pending)
+	saturated := ""
+	if status.Hashing.Saturated {
+		saturated = ", saturated"
+	}
+	fmt.Printf("  Hashing:    %d of %d workers busy, %d waiting on the stash%s\n",
+		status.Hashing.Busy, status.Hashing.Workers, status.Hashing.Waiting, saturated)
+	for _, loc := range status.Paused {
+		if loc == "" {
+			loc = "every location"
+		}
+		fmt.Printf("  Paused:     %s\n", loc)
+	}
+	if !status.LastSave.IsZero() {
+		fmt.Printf("  Last save:  %v\n", status.LastSave.Format(layout))
+	}
+	fmt.Printf("  Stash:      %d stashes, %d versions, %d bytes kept for %d (%d held, %d in trash)\n",
+		status.Stash.Nodes, status.Stash.Pointers, status.Stash.Physical, status.Stash.Logical, status.Stash.Held, status.Stash.Trash)
+	fmt.Printf("  Disk:       %s\n", status.Disk)
+	fmt.Println("  Locations:")
+	for _, ls := range status.Locations {
+		fmt.Printf("    %-40s %s\n", ls.Location, ls.State)
+	}
+	if len(status.Errors) > 0 {
+		fmt.Println("  Recent errors:")
+		for _, e := range status.Errors {
+			fmt.Printf("    %v %s\n", e.Date.Format(layout), e.Message)
+		}
+	}
+	fmt.Println()
+}
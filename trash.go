@@ -0,0 +1,270 @@
+package main
+
+/*-----------------------------------------------
+ trash.go
+
+ The recycle bin for removed files and stashes
+-----------------------------------------------*/
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/google/uuid"
+)
+
+/* TrashEntry is something removed from the stash that can still be
+   brought back, until it's emptied or outlives Trash_ttl_days.
+   - Id is the trash id, used to restore or empty the entry
+   - Date is when it was removed
+   - Node is the node as it was, Pointers only holds the pointers
+     that were removed
+   - Whole is set when the node's bytes went along with it, they
+     then live in Trash_loc under the original Node.Id */
+type TrashEntry struct {
+	Id    string
+	Date  time.Time
+	Node  Node
+	Whole bool
+}
+
+/* Move removed pointers, and the node's bytes if the node is gone
+   as a whole, into the trash. Each pointer is audited as removed by
+   by. When the bytes can't be moved nothing is trashed and the error
+   is returned, the node has to stay in the stash. */
+func (self *Meta) toTrash(node Node, removed []FilePointer, whole bool, by string) error {
+	entry := TrashEntry{uuid.New().String(), time.Now(), node, whole}
+	entry.Node.Pointers = removed
+	if whole {
+		os.MkdirAll(conf().Trash_loc, 0700)
+		err := moveFile(conf().Stash_loc+"/"+node.Id, conf().Trash_loc+"/"+node.Id)
+		if err != nil {
+			log.Errorln("Failed to move stash", node.Id, "to the trash, keeping it:", err)
+			return err
+		}
+	}
+	for _, fp := range removed {
+		audit.Record(AuditEntry{Event: "remove", By: by, Node: node.Id, Name: fp.Name, Version: fp.Version,
+			Location: fp.Location, Size: fp.Size, Outcome: "trashed", Delivery: fp.Delivery, Detail: entry.Id})
+		log.WithFields(log.Fields{"event": "remove", "outcome": "trashed", "node": node.Id, "trash": entry.Id,
+			"name": fp.Name, "location": fp.Location, "size": fp.Size}).Infoln("Trashed", fp.Name, "version", fp.Version)
+	}
+	log.Infoln("Moved", len(removed), "file(s) from stash", node.Id, "to the trash as", entry.Id)
+	self.Trash = append(self.Trash, entry)
+	return nil
+}
+
+/* Move a file between the stash and the trash, copying it when they
+   are on different file systems. The copy only takes the name to
+   once it's complete, and from goes once it has. */
+func moveFile(from string, to string) error {
+	err := os.Rename(from, to)
+	if lerr, ok := err.(*os.LinkError); !ok || lerr.Err != syscall.EXDEV {
+		return err
+	}
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	part := to + ".part"
+	dst, err := os.OpenFile(part, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(part, to)
+	}
+	if err != nil {
+		os.Remove(part)
+		return err
+	}
+	return os.Remove(from)
+}
+
+/* Find a trash entry by id, a unique prefix of the id will do */
+func (self *Meta) findTrash(id string) (idx int, err error) {
+	idx = -1
+	for itr := range self.Trash {
+		if strings.HasPrefix(self.Trash[itr].Id, id) {
+			if idx >= 0 {
+				return -1, errors.New("Trash id " + id + " is ambiguous")
+			}
+			idx = itr
+		}
+	}
+	if idx < 0 {
+		err = errors.New("Unable to find " + id + " in the trash")
+	}
+	return
+}
+
+/* Restore a trash entry, putting its pointers back on the node with
+   their original versions, or the whole node back under its
+   original id */
+func (self *Meta) RestoreTrash(id string) error {
+	idx, err := self.findTrash(id)
+	if err != nil {
+		return err
+	}
+	entry := self.Trash[idx]
+
+	var live *Node
+	for itr := range self.Files {
+		if self.Files[itr].Id == entry.Node.Id {
+			live = &self.Files[itr]
+		}
+	}
+	switch {
+	case live != nil:
+		for _, fp := range entry.Node.Pointers {
+			for _, have := range live.Pointers {
+				if have.Name == fp.Name && have.Version == fp.Version {
+					return fmt.Errorf("Stash %s already has %s version %d", live.Id, fp.Name, fp.Version)
+				}
+			}
+		}
+		live.Pointers = append(live.Pointers, entry.Node.Pointers...)
+	case entry.Whole:
+		err := moveFile(conf().Trash_loc+"/"+entry.Node.Id, conf().Stash_loc+"/"+entry.Node.Id)
+		if err != nil {
+			return err
+		}
+		self.Files = append(self.Files, entry.Node)
+		self.Count = len(self.Files)
+	default:
+		for _, other := range self.Trash {
+			if other.Whole && other.Node.Id == entry.Node.Id {
+				return errors.New("Stash " + entry.Node.Id + " is in the trash, restore " + other.Id + " first")
+			}
+		}
+		return errors.New("Stash " + entry.Node.Id + " no longer exists, unable to restore")
+	}
+	log.Infoln("Restored", entry.Id, "to stash", entry.Node.Id)
+	self.Trash = append(self.Trash[:idx], self.Trash[idx+1:]...)
+	self.RebuildLookup()
+	self.SaveStash()
+	return nil
+}
+
+/* Permanently delete trash entries, everything if no ids are given,
+   on behalf of by. Entries whose stash no longer exists anywhere go
+   with them. */
+func (self *Meta) EmptyTrash(ids []string, by string) error {
+	gone := map[string]bool{}
+	for _, id := range ids {
+		idx, err := self.findTrash(id)
+		if err != nil {
+			return err
+		}
+		gone[self.Trash[idx].Id] = true
+	}
+	if len(ids) == 0 {
+		for _, entry := range self.Trash {
+			gone[entry.Id] = true
+		}
+	}
+	self.dropTrash(gone, by)
+	return nil
+}
+
+/* Empty everything older than Trash_ttl_days, a ttl of 0 keeps
+   the trash forever */
+func (self *Meta) ExpireTrash() {
+	if conf().Trash_ttl_days <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-time.Duration(conf().Trash_ttl_days) * 24 * time.Hour)
+	gone := map[string]bool{}
+	for _, entry := range self.Trash {
+		if entry.Date.Before(cutoff) {
+			gone[entry.Id] = true
+		}
+	}
+	if len(gone) > 0 {
+		log.Infoln("Emptying", len(gone), "expired trash entries")
+		self.dropTrash(gone, "trash expiry")
+	}
+}
+
+/* Delete the given trash entries, then any pointer only entries
+   left without a stash to go back to. Their pointers are audited as
+   purged. */
+func (self *Meta) dropTrash(gone map[string]bool, by string) {
+	var keep []TrashEntry
+	for _, entry := range self.Trash {
+		if gone[entry.Id] {
+			if entry.Whole {
+				os.Remove(conf().Trash_loc + "/" + entry.Node.Id)
+			}
+			log.Infoln("Emptied", entry.Id, "from the trash")
+			entry.purged(by, "emptied")
+			continue
+		}
+		keep = append(keep, entry)
+	}
+	self.Trash = nil
+	for _, entry := range keep {
+		if !entry.Whole && !self.hasStash(entry.Node.Id, keep) {
+			log.Infoln("Emptied", entry.Id, "from the trash, its stash is gone")
+			entry.purged(by, "orphaned")
+			continue
+		}
+		self.Trash = append(self.Trash, entry)
+	}
+	self.SaveStash()
+}
+
+/* Is there anywhere the bytes of a stash still live */
+func (self *Meta) hasStash(id string, trash []TrashEntry) bool {
+	for itr := range self.Files {
+		if self.Files[itr].Id == id {
+			return true
+		}
+	}
+	for _, entry := range trash {
+		if entry.Whole && entry.Node.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+/* Print the trash for the trash list command */
+func printTrash(trash []TrashEntry) {
+	const layout = "Jan 02 06 15:04:23"
+	for _, entry := range trash {
+		expires := "never"
+		if conf().Trash_ttl_days > 0 {
+			expires = entry.Date.Add(time.Duration(conf().Trash_ttl_days) * 24 * time.Hour).Format(layout)
+		}
+		for _, fp := range entry.Node.Pointers {
+			nm := fp.Name
+			if len(fp.Name) > 30 {
+				nm = fp.Name[:27] + "..."
+			}
+			fmt.Printf("%-36s %-36s %-30s %3d %v  expires: %s\n",
+				entry.Id, entry.Node.Id, nm, fp.Version, entry.Date.Format(layout), expires)
+		}
+	}
+}
+
+/* Audit the pointers of an entry as gone for good */
+func (self TrashEntry) purged(by string, outcome string) {
+	for _, fp := range self.Node.Pointers {
+		audit.Record(AuditEntry{Event: "purge", By: by, Node: self.Node.Id, Name: fp.Name, Version: fp.Version,
+			Location: fp.Location, Size: fp.Size, Outcome: outcome, Delivery: fp.Delivery, Detail: self.Id})
+	}
+}
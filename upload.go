@@ -0,0 +1,316 @@
+package main
+
+/*-----------------------------------------------
+ upload.go
+
+ Resumable HTTP uploads straight into staging,
+ following the tus protocol (tus.io)
+-----------------------------------------------*/
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/google/uuid"
+)
+
+/* Upload is the state of one resumable upload. The bytes go to
+   Staging_loc/Id and the state sits next to them in Id.upload, so an
+   interrupted upload can pick up where it left off, even across a
+   restart of the daemon. Once Offset reaches Length the staged file
+   is handed to the stash like any other pickup. */
+type Upload struct {
+	Id       string
+	Name     string
+	Location string
+	Length   int64
+	Offset   int64
+	Created  time.Time
+}
+
+/* One lock per upload id, a client must not PATCH the same upload
+   twice at the same time */
+var (
+	upload_mu    sync.Mutex
+	upload_locks = map[string]*sync.Mutex{}
+)
+
+func lockUpload(id string) func() {
+	upload_mu.Lock()
+	mu := upload_locks[id]
+	if mu == nil {
+		mu = &sync.Mutex{}
+		upload_locks[id] = mu
+	}
+	upload_mu.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+func forgetUpload(id string) {
+	upload_mu.Lock()
+	delete(upload_locks, id)
+	upload_mu.Unlock()
+}
+
+func uploadState(id string) string {
+	return conf().Staging_loc + "/" + id + ".upload"
+}
+
+func loadUpload(id string) (up Upload, err error) {
+	if _, err = uuid.Parse(id); err != nil { //ids end up in file names
+		return up, errors.New("Invalid upload id")
+	}
+	bts, err := ioutil.ReadFile(uploadState(id))
+	if err != nil {
+		return up, errors.New("Unable to find upload " + id)
+	}
+	err = json.Unmarshal(bts, &up)
+	return
+}
+
+func (self *Upload) save() error {
+	bts, err := json.Marshal(self)
+	if err != nil {
+		return err
+	}
+	tmp := uploadState(self.Id) + ".new"
+	if err = ioutil.WriteFile(tmp, bts, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, uploadState(self.Id))
+}
+
+/* Throw an upload away, bytes and all */
+func (self *Upload) discard() {
+	os.Remove(conf().Staging_loc + "/" + self.Id)
+	os.Remove(uploadState(self.Id))
+	forgetUpload(self.Id)
+}
+
+/* Parse the tus Upload-Metadata header, comma separated key and
+   base64 value pairs */
+func uploadMetadata(header string) map[string]string {
+	md := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		kv := strings.Fields(pair)
+		if len(kv) == 0 {
+			continue
+		}
+		md[kv[0]] = ""
+		if len(kv) > 1 {
+			if v, err := base64.StdEncoding.DecodeString(kv[1]); err == nil {
+				md[kv[0]] = string(v)
+			}
+		}
+	}
+	return md
+}
+
+/* /api/uploads and /api/uploads/{id}:
+   - OPTIONS lists what we support
+   - POST creates an upload, Upload-Length and Upload-Metadata with a
+     filename are required
+   - HEAD reports the current Upload-Offset
+   - PATCH appends at Upload-Offset
+   - DELETE abandons an upload */
+func handleUploads(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", "1.0.0")
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/uploads"), "/")
+	if id != "" { //before any lock is taken, each id gets one for good
+		parsed, err := uuid.Parse(id)
+		if err != nil {
+			writeError(w, http.StatusNotFound, errors.New("Invalid upload id"))
+			return
+		}
+		id = parsed.String()
+	}
+
+	switch {
+	case r.Method == "OPTIONS":
+		w.Header().Set("Tus-Version", "1.0.0")
+		w.Header().Set("Tus-Extension", "creation,termination")
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "POST" && id == "":
+		createUpload(w, r)
+	case r.Method == "HEAD" && id != "":
+		defer lockUpload(id)()
+		up, err := loadUpload(id)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if up.Offset == up.Length && finishUpload(up) != nil { //complete, but it didn't make it to the stash
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(up.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(up.Length, 10))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+	case r.Method == "PATCH" && id != "":
+		patchUpload(w, r, id)
+	case r.Method == "DELETE" && id != "":
+		defer lockUpload(id)()
+		up, err := loadUpload(id)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		log.Infoln("Upload", up.Id, "of", up.Name, "abandoned by the client")
+		up.discard()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+	}
+}
+
+func createUpload(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("Upload-Length is required"))
+		return
+	}
+	name := filepath.Base(uploadMetadata(r.Header.Get("Upload-Metadata"))["filename"])
+	if name == "." || name == "/" {
+		writeError(w, http.StatusBadRequest, errors.New("Upload-Metadata must carry a filename"))
+		return
+	}
+	if !disk.Check() {
+		writeError(w, http.StatusInsufficientStorage, errors.New("The stash is out of space"))
+		return
+	}
+	if ok, wait := limiter.Allow(conf().Upload_location, length); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, errors.New("Too many uploads, try again later"))
+		return
+	}
+
+	up := Upload{uuid.New().String(), name, conf().Upload_location, length, 0, time.Now()}
+	fl, err := os.OpenFile(conf().Staging_loc+"/"+up.Id, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err == nil {
+		fl.Close()
+		err = up.save()
+	}
+	if err != nil {
+		log.Errorln("Failed to create upload:", err)
+		up.discard()
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.Infoln("Upload", up.Id, "of", up.Name, "started,", up.Length, "bytes from", r.RemoteAddr)
+	if up.Length == 0 {
+		if err = finishUpload(up); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	w.Header().Set("Location", "/api/uploads/"+up.Id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func patchUpload(w http.ResponseWriter, r *http.Request, id string) {
+	defer lockUpload(id)()
+	up, err := loadUpload(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeError(w, http.StatusUnsupportedMediaType, errors.New("Content-Type must be application/offset+octet-stream"))
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != up.Offset {
+		writeError(w, http.StatusConflict, fmt.Errorf("Upload-Offset must be %d", up.Offset))
+		return
+	}
+	if !disk.Check() {
+		writeError(w, http.StatusInsufficientStorage, errors.New("The stash is out of space"))
+		return
+	}
+
+	fl, err := os.OpenFile(conf().Staging_loc+"/"+up.Id, os.O_WRONLY, 0600)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	fl.Seek(up.Offset, 0)
+	//keep whatever made it before the connection dropped, that's
+	//what the client resumes from
+	wrote, err := io.Copy(fl, io.LimitReader(r.Body, up.Length-up.Offset))
+	fl.Close()
+	up.Offset += wrote
+	if serr := up.save(); serr != nil {
+		log.Errorln("Failed to save upload state for", up.Id, ":", serr)
+	}
+	if err != nil {
+		log.Warnln("Upload", up.Id, "interrupted at", up.Offset, "of", up.Length, "bytes:", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if up.Offset == up.Length {
+		if err = finishUpload(up); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(up.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/* Hand a completed upload to the stash. It has to be journaled
+   first; if it can't be, its state stays so a HEAD can try again,
+   the client mustn't be told it's done. */
+func finishUpload(up Upload) error {
+	log.WithFields(log.Fields{"event": "pickup", "id": up.Id, "name": up.Name, "location": up.Location,
+		"size": up.Length}).Info("Upload ", up.Id, " of ", up.Name, " complete, handing it to the stash")
+	var op Operation
+	op.Code = ProcessFile
+	op.Id = up.Id
+	op.Name = path.Base(up.Name)
+	op.Location = up.Location
+	op.delivery = deliveries.For(op.Location)
+	op.picked = time.Now()
+	if err := journal.Add(op); err != nil {
+		log.Errorln("Failed to journal upload", up.Id, ":", err)
+		return errors.New("Unable to hand the upload to the stash")
+	}
+	os.Remove(uploadState(up.Id))
+	forgetUpload(up.Id)
+	intake.Submit(op)
+	return nil
+}
+
+/* Throw away uploads nobody touched in Upload_expire_hours */
+func expireUploads() {
+	if conf().Upload_expire_hours <= 0 {
+		return
+	}
+	states, _ := filepath.Glob(conf().Staging_loc + "/*.upload")
+	for _, state := range states {
+		id := strings.TrimSuffix(filepath.Base(state), ".upload")
+		st, err := os.Stat(state)
+		if err != nil || time.Since(st.ModTime()) < conf().Upload_expire_hours*time.Hour {
+			continue
+		}
+		unlock := lockUpload(id)
+		if up, err := loadUpload(id); err == nil {
+			log.Infoln("Upload", up.Id, "of", up.Name, "expired at", up.Offset, "of", up.Length, "bytes")
+			up.discard()
+		}
+		unlock()
+	}
+}